@@ -0,0 +1,340 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The log being written is daemon.log. Once it reaches audit.maxSize it is renamed with the time it was rotated,
+//and only the newest audit.retention rotated files are kept.
+const (
+	logName   = "daemon"
+	logSuffix = ".log"
+)
+
+//Filters for the audit log. Empty fields match every entry.
+type Query struct {
+	//Most entries to return
+	Limit int
+	//UNIX times the entries were recorded between, inclusive
+	From int64
+	To   int64
+
+	Actor     string
+	Action    string
+	Server    string
+	Transport string
+	Result    string
+	//Only entries with a path starting with this
+	Path string
+	//Only entries with a command containing this
+	Command string
+}
+
+var logFile *os.File
+var logSize int64
+var logLock = sync.Mutex{}
+
+func getLogFolder() string {
+	return viper.GetString("data.audit")
+}
+
+//Appends the entry to the audit log, if it is enabled. Entries without a time are given the current time.
+func Record(entry pufferd.AuditEntry) {
+	if !viper.GetBool("audit.enabled") {
+		return
+	}
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logging.Exception("error encoding audit entry", err)
+		return
+	}
+	data = append(data, '\n')
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	maxSize := viper.GetInt64("audit.maxSize") * 1024 * 1024
+	if logFile != nil && maxSize > 0 && logSize+int64(len(data)) > maxSize {
+		rotate()
+	}
+
+	if logFile == nil {
+		if err = open(); err != nil {
+			logging.Exception("error opening audit log", err)
+			return
+		}
+	}
+
+	n, err := logFile.Write(data)
+	logSize += int64(n)
+	if err != nil {
+		logging.Exception("error writing audit log", err)
+	}
+}
+
+//Key the route's action is stored under in the request's context
+const actionKey = "auditAction"
+
+//Marks the route as taking the action, so Middleware records requests to it.
+//It must come before the route's auth handlers, so requests they deny are recorded too.
+func Action(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		SetAction(c, action)
+	}
+}
+
+//Sets the action the request is recorded as, for routes whose action depends on the request.
+func SetAction(c *gin.Context, action string) {
+	c.Set(actionKey, action)
+}
+
+//Stops Middleware recording the request, for handlers that have recorded it themselves in more detail.
+func Recorded(c *gin.Context) {
+	SetAction(c, "")
+}
+
+//Records an entry for each request to a route marked with Action, after it has been handled.
+//The actor is the subject of the request's token.
+func Middleware(c *gin.Context) {
+	c.Next()
+
+	action := c.GetString(actionKey)
+	if action == "" {
+		return
+	}
+
+	status := c.Writer.Status()
+	entry := pufferd.AuditEntry{
+		Actor:     c.GetString("subject"),
+		Address:   c.ClientIP(),
+		Transport: pufferd.CommandTransportHttp,
+		Action:    action,
+		Server:    c.Param("id"),
+		Path:      c.Param("filename"),
+		Status:    status,
+		Result:    GetResult(status),
+	}
+	if len(c.Errors) > 0 {
+		entry.Error = c.Errors.Last().Error()
+	}
+	Record(entry)
+}
+
+//Gets the audit result for an HTTP status.
+func GetResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return pufferd.AuditResultDenied
+	case status >= 400:
+		return pufferd.AuditResultFailure
+	default:
+		return pufferd.AuditResultSuccess
+	}
+}
+
+//Gets the entries matching the query from the audit log and its rotated files, newest first.
+func Search(query Query) ([]pufferd.AuditEntry, error) {
+	logLock.Lock()
+	files, err := getLogFiles()
+	logLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]pufferd.AuditEntry, 0)
+	for _, file := range files {
+		entries, err := readLog(apufferi.JoinPath(getLogFolder(), file))
+		if err != nil {
+			return nil, err
+		}
+
+		for i := len(entries) - 1; i >= 0; i-- {
+			if query.Limit > 0 && len(result) >= query.Limit {
+				return result, nil
+			}
+			if query.matches(entries[i]) {
+				result = append(result, entries[i])
+			}
+		}
+
+		//files are newest first, so nothing older can match
+		if query.From > 0 && len(entries) > 0 && entries[0].Time < query.From {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (q Query) matches(entry pufferd.AuditEntry) bool {
+	if q.From > 0 && entry.Time < q.From {
+		return false
+	}
+	if q.To > 0 && entry.Time > q.To {
+		return false
+	}
+	if q.Actor != "" && entry.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && entry.Action != q.Action {
+		return false
+	}
+	if q.Server != "" && entry.Server != q.Server {
+		return false
+	}
+	if q.Transport != "" && entry.Transport != q.Transport {
+		return false
+	}
+	if q.Result != "" && entry.Result != q.Result {
+		return false
+	}
+	if q.Path != "" && !strings.HasPrefix(entry.Path, q.Path) {
+		return false
+	}
+	if q.Command != "" && !strings.Contains(entry.Command, q.Command) {
+		return false
+	}
+	return true
+}
+
+//Callers must hold logLock.
+func open() error {
+	folder := getLogFolder()
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(apufferi.JoinPath(folder, logName+logSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		apufferi.Close(file)
+		return err
+	}
+
+	logFile = file
+	logSize = info.Size()
+	return nil
+}
+
+//Renames the current log with the time it was rotated, and removes the oldest rotated logs past the retention.
+//Callers must hold logLock.
+func rotate() {
+	apufferi.Close(logFile)
+	logFile = nil
+	logSize = 0
+
+	folder := getLogFolder()
+	rotated := logName + "-" + time.Now().Format("20060102-150405.000000000") + logSuffix
+	err := os.Rename(apufferi.JoinPath(folder, logName+logSuffix), apufferi.JoinPath(folder, rotated))
+	if err != nil {
+		logging.Exception("error rotating audit log", err)
+		return
+	}
+
+	files, err := getLogFiles()
+	if err != nil {
+		logging.Exception("error pruning audit logs", err)
+		return
+	}
+
+	//the current log was just renamed, so these are all rotated logs
+	for i := viper.GetInt("audit.retention"); i < len(files); i++ {
+		err = os.Remove(apufferi.JoinPath(folder, files[i]))
+		if err != nil {
+			logging.Exception("error removing audit log "+files[i], err)
+		}
+	}
+}
+
+//Gets the names of the audit logs, newest first. The current log, if it exists, is first.
+//Callers must hold logLock.
+func getLogFiles() ([]string, error) {
+	infos, err := ioutil.ReadDir(getLogFolder())
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	current := false
+	rotated := make([]string, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if name == logName+logSuffix {
+			current = true
+		} else if strings.HasPrefix(name, logName+"-") && strings.HasSuffix(name, logSuffix) {
+			rotated = append(rotated, name)
+		}
+	}
+
+	//rotated names sort by the time they were rotated
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	if current {
+		return append([]string{logName + logSuffix}, rotated...), nil
+	}
+	return rotated, nil
+}
+
+//Reads every entry in a log, oldest first.
+func readLog(path string) ([]pufferd.AuditEntry, error) {
+	entries := make([]pufferd.AuditEntry, 0)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer apufferi.Close(file)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry pufferd.AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
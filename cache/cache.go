@@ -17,17 +17,164 @@
 package cache
 
 import (
-	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/pufferd/v2"
 	"github.com/spf13/viper"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-func CreateCache() *apufferi.MemoryCache {
+//Marks daemon lines in the plain text console
+const DaemonPrefix = "[DAEMON] "
+
+//Keeps the last console.buffer lines written to a console.
+//Output is split into lines as it is written. A line without a newline yet is held, for each source and stream,
+//until it is finished.
+type ConsoleCache struct {
+	lines    []pufferd.ConsoleLine
+	partials map[string]*pufferd.ConsoleLine
+	sequence uint64
+	capacity int
+	lock     sync.Mutex
+}
+
+func CreateCache() *ConsoleCache {
 	capacity := viper.GetInt("console.buffer")
 	if capacity <= 0 {
 		capacity = 50
 	}
-	return &apufferi.MemoryCache{
-		Buffer:   make([]apufferi.Message, 0),
-		Capacity: capacity,
+	return &ConsoleCache{
+		lines:    make([]pufferd.ConsoleLine, 0, capacity),
+		partials: make(map[string]*pufferd.ConsoleLine),
+		capacity: capacity,
+	}
+}
+
+func (c *ConsoleCache) Read() (msg []string, lastTime int64) {
+	msg, lastTime = c.ReadFrom(0)
+	return
+}
+
+//Reads the lines written after the given UNIX time as plain text, with their newlines.
+//Daemon lines are prefixed with [DAEMON], and unfinished lines are last.
+func (c *ConsoleCache) ReadFrom(startTime int64) (msg []string, lastTime int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	msg = make([]string, 0)
+	for _, v := range c.lines {
+		if v.Time > startTime {
+			msg = append(msg, ToPlain(v)+"\n")
+			lastTime = v.Time
+		}
+	}
+	for _, v := range c.getPartials() {
+		if v.Time > startTime {
+			msg = append(msg, ToPlain(v))
+		}
+	}
+
+	if lastTime == 0 {
+		lastTime = time.Now().Unix()
+	}
+	return
+}
+
+//Gets a copy of the finished lines held, oldest first.
+func (c *ConsoleCache) Lines() []pufferd.ConsoleLine {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]pufferd.ConsoleLine, len(c.lines))
+	copy(result, c.lines)
+	return result
+}
+
+//Gets a copy of the finished lines held, followed by any unfinished lines.
+func (c *ConsoleCache) Entries() []pufferd.ConsoleLine {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]pufferd.ConsoleLine, len(c.lines))
+	copy(result, c.lines)
+	return append(result, c.getPartials()...)
+}
+
+//Writes process output to stdout.
+func (c *ConsoleCache) Write(b []byte) (n int, err error) {
+	c.WriteFrom(pufferd.ConsoleSourceProcess, pufferd.ConsoleStreamStdout, b)
+	return len(b), nil
+}
+
+//Writes output from the given source and stream, returning the lines it finished.
+//If the output ends without a newline, what is left is also returned, as a partial line.
+func (c *ConsoleCache) WriteFrom(source, stream string, b []byte) []pufferd.ConsoleLine {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().Unix()
+	key := source + "/" + stream
+
+	data := string(b)
+	if partial := c.partials[key]; partial != nil {
+		data = partial.Line + data
+		delete(c.partials, key)
+	}
+
+	result := make([]pufferd.ConsoleLine, 0)
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		c.sequence++
+		line := pufferd.ConsoleLine{
+			Sequence: c.sequence,
+			Time:     now,
+			Source:   source,
+			Stream:   stream,
+			Line:     strings.TrimSuffix(data[:i], "\r"),
+		}
+		c.add(line)
+		result = append(result, line)
+		data = data[i+1:]
+	}
+
+	if data != "" {
+		partial := &pufferd.ConsoleLine{Time: now, Source: source, Stream: stream, Line: data, Partial: true}
+		c.partials[key] = partial
+		result = append(result, *partial)
+	}
+
+	return result
+}
+
+//Callers must hold the lock.
+func (c *ConsoleCache) add(line pufferd.ConsoleLine) {
+	if len(c.lines) == c.capacity {
+		copy(c.lines, c.lines[1:])
+		c.lines = c.lines[:len(c.lines)-1]
+	}
+	c.lines = append(c.lines, line)
+}
+
+//Callers must hold the lock.
+func (c *ConsoleCache) getPartials() []pufferd.ConsoleLine {
+	result := make([]pufferd.ConsoleLine, 0, len(c.partials))
+	for _, v := range c.partials {
+		result = append(result, *v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Source+result[i].Stream < result[j].Source+result[j].Stream
+	})
+	return result
+}
+
+//Gets the line as it appears in the plain text console.
+func ToPlain(line pufferd.ConsoleLine) string {
+	if line.Source == pufferd.ConsoleSourceDaemon {
+		return DaemonPrefix + line.Line
 	}
+	return line.Line
 }
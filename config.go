@@ -16,6 +16,10 @@ func SetDefaults() {
 	//defaults we can set at this point in time
 	viper.SetDefault("console.buffer", 50)
 	viper.SetDefault("console.forward", false)
+	viper.SetDefault("console.logs", true)
+	viper.SetDefault("console.logMaxSize", 10)
+	viper.SetDefault("console.logMaxAge", 24)
+	viper.SetDefault("console.logRetention", 10)
 
 	viper.SetDefault("listen.web", "0.0.0.0:5656")
 	//viper.SetDefault("listen.socket", "unix:/var/run/pufferd.sock")
@@ -23,6 +27,7 @@ func SetDefaults() {
 	viper.SetDefault("listen.webKey", "https.key")
 	viper.SetDefault("listen.sftp", "0.0.0.0:5657")
 	viper.SetDefault("listen.sftpKey", "sftp.key")
+	viper.SetDefault("listen.metrics", "")
 
 	viper.SetDefault("auth.publicKey", "panel.pem")
 
@@ -35,8 +40,43 @@ func SetDefaults() {
 	viper.SetDefault("data.servers", "servers")
 	viper.SetDefault("data.modules", "modules")
 	viper.SetDefault("data.logs", "logs")
+	viper.SetDefault("data.backups", "backups")
+	viper.SetDefault("data.backupLimit", 5)
+	viper.SetDefault("data.stopTimeout", 30)
+	viper.SetDefault("data.crashes", "crashes")
 	viper.SetDefault("data.crashLimit", 3)
+	viper.SetDefault("data.crashWindow", 600)
+	viper.SetDefault("data.crashBackoff", 5)
+	viper.SetDefault("data.crashBackoffMax", 300)
+	viper.SetDefault("data.crashHistory", 20)
+	viper.SetDefault("data.crashConsoleLines", 50)
+	viper.SetDefault("data.stats", "stats")
+	viper.SetDefault("data.webhooks", "webhooks")
+	viper.SetDefault("data.audit", "audit")
 	viper.SetDefault("data.maxWSDownloadSize", int64(1024*1024*20)) //1024 bytes (1KB) * 1024 (1MB) * 50 (50MB))
+
+	viper.SetDefault("audit.enabled", true)
+	viper.SetDefault("audit.maxSize", 10)
+	viper.SetDefault("audit.retention", 10)
+
+	viper.SetDefault("websocket.queue", 256)
+	viper.SetDefault("websocket.slowPolicy", "disconnect")
+	viper.SetDefault("websocket.pingInterval", 30)
+	viper.SetDefault("websocket.writeTimeout", 10)
+
+	viper.SetDefault("cgroups.root", "/sys/fs/cgroup/pufferd")
+
+	viper.SetDefault("stats.minInterval", 1)
+	viper.SetDefault("stats.maxInterval", 300)
+	viper.SetDefault("stats.historyInterval", 10)
+	viper.SetDefault("stats.historyRetention", 3600)
+	viper.SetDefault("stats.historyPersist", false)
+
+	viper.SetDefault("webhooks.secret", "")
+	viper.SetDefault("webhooks.retries", 8)
+	viper.SetDefault("webhooks.backoff", 5)
+	viper.SetDefault("webhooks.backoffMax", 3600)
+	viper.SetDefault("webhooks.timeout", 10)
 }
 
 func LoadConfig() error {
@@ -6,10 +6,12 @@ import (
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/pufferd/v2"
 	"github.com/pufferpanel/pufferd/v2/environments"
+	"github.com/pufferpanel/pufferd/v2/metrics"
 	"github.com/pufferpanel/pufferd/v2/programs"
 	"github.com/pufferpanel/pufferd/v2/routing"
 	"github.com/pufferpanel/pufferd/v2/sftp"
 	"github.com/pufferpanel/pufferd/v2/shutdown"
+	"github.com/pufferpanel/pufferd/v2/webhooks"
 	"github.com/spf13/viper"
 	"os"
 	"os/signal"
@@ -46,6 +48,8 @@ func entry(errChan chan error) {
 
 	programs.InitService()
 
+	webhooks.Start()
+
 	for _, element := range programs.GetAll() {
 		if element.IsEnabled() {
 			element.GetEnvironment().DisplayToConsole(true, "Daemon has been started\n")
@@ -88,6 +92,7 @@ func runServices() error {
 	}
 
 	sftp.Run()
+	metrics.Run()
 
 	web := viper.GetString("listen.web")
 
@@ -0,0 +1,32 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+)
+
+//Moves the server's process into the group as soon as it has started, then reports limit violations to the console.
+//The process should be stopped if this fails, as nothing limits it.
+func (g *Group) Started(env envs.Environment, pid int) error {
+	err := g.join(pid)
+	if err != nil {
+		return err
+	}
+	g.Watch(env)
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"bufio"
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cpuPeriod = 100000
+
+var controllers = []string{"memory", "cpu", "pids", "io"}
+
+type Group struct {
+	path     string
+	start    events
+	last     events
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type events struct {
+	memoryMax uint64
+	oomKill   uint64
+	pidsMax   uint64
+}
+
+//Creates the cgroup v2 group for the server under cgroups.root and writes the limits to it.
+//Limits which are not set are reset to the kernel maximum.
+func Create(id string, limits envs.ResourceLimits) (*Group, error) {
+	root := viper.GetString("cgroups.root")
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	//the children can only use the controllers their parent hands down
+	for _, v := range controllers {
+		_ = ioutil.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+"+v), 0644)
+	}
+
+	g := &Group{path: filepath.Join(root, id), done: make(chan struct{})}
+	err = os.Mkdir(g.path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	err = g.setLimits(limits)
+	if err != nil {
+		//a group without its limits must not be used
+		_ = os.Remove(g.path)
+		return nil, err
+	}
+
+	g.start = g.readEvents()
+	g.last = g.start
+	return g, nil
+}
+
+func (g *Group) setLimits(limits envs.ResourceLimits) (err error) {
+	memory, cpu, pids := "max", "max", "max"
+	if limits.Memory > 0 {
+		memory = strconv.FormatInt(limits.Memory*1024*1024, 10)
+	}
+	if limits.CPU > 0 {
+		cpu = strconv.FormatInt(limits.CPU*cpuPeriod/100, 10) + " " + strconv.Itoa(cpuPeriod)
+	}
+	if limits.Pids > 0 {
+		pids = strconv.FormatInt(limits.Pids, 10)
+	}
+
+	if err = g.write("memory.max", memory); err != nil {
+		return
+	}
+	if err = g.write("cpu.max", cpu); err != nil {
+		return
+	}
+	if err = g.write("pids.max", pids); err != nil {
+		return
+	}
+	if limits.IOWeight > 0 {
+		err = g.write("io.weight", "default "+strconv.FormatInt(limits.IOWeight, 10))
+	}
+	return
+}
+
+//Moves the process into the group. Processes it has already started stay where they are.
+func (g *Group) join(pid int) error {
+	return g.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+//Reports limit violations to the console of the environment until the group is closed.
+func (g *Group) Watch(env envs.Environment) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+				g.report(env)
+			}
+		}
+	}()
+}
+
+//Returns true if the kernel killed a process in this group for running out of memory.
+func (g *Group) OOMKilled() bool {
+	return g.readEvents().oomKill > g.start.oomKill
+}
+
+//Stops watching the group and removes it.
+//Removing fails while processes are still in the group, in which case it is left for the next run to reuse.
+func (g *Group) Close() error {
+	g.stopOnce.Do(func() {
+		close(g.done)
+	})
+	err := os.Remove(g.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (g *Group) report(env envs.Environment) {
+	current := g.readEvents()
+	if current.oomKill > g.last.oomKill {
+		env.DisplayToConsole(true, "Memory limit exceeded, a process was killed\n")
+	} else if current.memoryMax > g.last.memoryMax {
+		env.DisplayToConsole(true, "Memory limit reached\n")
+	}
+	if current.pidsMax > g.last.pidsMax {
+		env.DisplayToConsole(true, "Process limit reached, a process or thread could not be started\n")
+	}
+	g.last = current
+}
+
+func (g *Group) readEvents() events {
+	result := events{}
+	g.readKeyed("memory.events", func(key string, value uint64) {
+		switch key {
+		case "max":
+			result.memoryMax = value
+		case "oom_kill":
+			result.oomKill = value
+		}
+	})
+	g.readKeyed("pids.events", func(key string, value uint64) {
+		if key == "max" {
+			result.pidsMax = value
+		}
+	})
+	return result
+}
+
+//Reads a flat keyed file, such as memory.events, passing each key and value to the handler.
+func (g *Group) readKeyed(name string, handler func(key string, value uint64)) {
+	file, err := os.Open(filepath.Join(g.path, name))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		handler(parts[0], value)
+	}
+}
+
+func (g *Group) write(name, value string) error {
+	return ioutil.WriteFile(filepath.Join(g.path, name), []byte(value), 0644)
+}
@@ -0,0 +1,47 @@
+// +build !linux
+
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+)
+
+type Group struct {
+}
+
+//Resource limits require cgroups, which are only available on Linux.
+func Create(id string, limits envs.ResourceLimits) (*Group, error) {
+	return nil, pufferd.ErrNotSupported
+}
+
+func (g *Group) join(pid int) error {
+	return pufferd.ErrNotSupported
+}
+
+func (g *Group) Watch(env envs.Environment) {
+}
+
+func (g *Group) OOMKilled() bool {
+	return false
+}
+
+func (g *Group) Close() error {
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/pufferpanel/pufferd/v2/environments/impl/docker"
 	"github.com/pufferpanel/pufferd/v2/environments/impl/standard"
 	"github.com/pufferpanel/pufferd/v2/utils"
+	"github.com/spf13/viper"
 	"sync"
 )
 
@@ -62,6 +63,9 @@ func Create(environmentType, folder, id string, environmentSection interface{})
 	}
 	e.WSManager = wsManager
 	e.ConsoleBuffer = envCache
+	if viper.GetBool("console.logs") {
+		e.ConsoleLog = envs.CreateConsoleLog(apufferi.JoinPath(viper.GetString("data.logs"), id))
+	}
 	e.Wait = &sync.WaitGroup{}
 
 	return item, nil
@@ -0,0 +1,82 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package envs
+
+import (
+	"bytes"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/cache"
+	"os"
+	"sync"
+)
+
+//Sends output to everything that keeps or shows a console: the buffer, sockets, the log file and the line count.
+type consoleWriter struct {
+	env     *BaseEnvironment
+	source  string
+	stream  string
+	forward bool
+}
+
+func (w *consoleWriter) Write(p []byte) (n int, err error) {
+	e := w.env
+	plain := p
+	if w.source == pufferd.ConsoleSourceDaemon {
+		plain = append([]byte(cache.DaemonPrefix), p...)
+	}
+
+	lines := e.ConsoleBuffer.WriteFrom(w.source, w.stream, p)
+	_ = e.WSManager.WriteConsole(plain, lines)
+	_, _ = e.ConsoleLines.Write(plain)
+	if e.ConsoleLog != nil {
+		_, _ = e.ConsoleLog.Write(plain)
+	}
+	if w.forward {
+		_, _ = os.Stdout.Write(plain)
+	}
+
+	if listener := e.LineListener; listener != nil {
+		for _, line := range lines {
+			if !line.Partial {
+				listener(line)
+			}
+		}
+	}
+	return len(p), nil
+}
+
+//Counts the lines written to a console, for reporting how much output a server produces.
+type LineCounter struct {
+	count uint64
+	lock  sync.Mutex
+}
+
+func (l *LineCounter) Write(p []byte) (n int, err error) {
+	lines := uint64(bytes.Count(p, []byte{'\n'}))
+	if lines > 0 {
+		l.lock.Lock()
+		l.count += lines
+		l.lock.Unlock()
+	}
+	return len(p), nil
+}
+
+func (l *LineCounter) Count() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.count
+}
@@ -0,0 +1,233 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package envs
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const consoleLogPrefix = "console-"
+const consoleLogTimeFormat = "20060102-150405.000"
+
+//Writes console output to a file, starting a new segment when the current one gets too large or too old.
+//Segments are named after the time they were started and are never renamed, so they can be referred to later.
+//Old segments are compressed, and only the newest console.logRetention are kept besides the current one.
+type ConsoleLog struct {
+	folder string
+	name   string
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+	failed bool
+	lock   sync.Mutex
+}
+
+func CreateConsoleLog(folder string) *ConsoleLog {
+	return &ConsoleLog{folder: folder}
+}
+
+//Reports whether the given file name is a segment of a console log.
+func IsConsoleLogFile(name string) bool {
+	return strings.HasPrefix(name, consoleLogPrefix) && (strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz"))
+}
+
+//Errors are logged rather than returned, so a full disk does not stop output reaching the console.
+func (l *ConsoleLog) Write(p []byte) (n int, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return len(p), nil
+	}
+
+	if l.file == nil {
+		err = l.open()
+	} else if l.shouldRotate() {
+		err = l.rotate()
+	}
+
+	if err == nil {
+		n, err = l.file.Write(p)
+		l.size += int64(n)
+	}
+
+	if err != nil {
+		if !l.failed {
+			logging.Exception("error writing console log to "+l.folder, err)
+		}
+		l.failed = true
+	} else {
+		l.failed = false
+	}
+	return len(p), nil
+}
+
+func (l *ConsoleLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+//Callers must hold the lock.
+func (l *ConsoleLog) shouldRotate() bool {
+	maxSize := viper.GetInt64("console.logMaxSize") * 1024 * 1024
+	if maxSize > 0 && l.size >= maxSize {
+		return true
+	}
+	maxAge := time.Duration(viper.GetInt("console.logMaxAge")) * time.Hour
+	return maxAge > 0 && time.Since(l.opened) >= maxAge
+}
+
+//Starts a new segment.
+//Segments left uncompressed by an earlier run of the daemon are compressed first,
+//so each segment only holds output from a single run.
+//Callers must hold the lock.
+func (l *ConsoleLog) open() error {
+	err := os.MkdirAll(l.folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	if l.name == "" {
+		files, err := ioutil.ReadDir(l.folder)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.IsDir() && IsConsoleLogFile(file.Name()) && strings.HasSuffix(file.Name(), ".log") {
+				l.archive(file.Name())
+			}
+		}
+	}
+
+	now := time.Now()
+	name := consoleLogPrefix + now.Format(consoleLogTimeFormat) + ".log"
+	l.file, err = os.OpenFile(apufferi.JoinPath(l.folder, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.name = name
+	l.size = 0
+	l.opened = now
+	return nil
+}
+
+//Callers must hold the lock.
+func (l *ConsoleLog) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	l.archive(l.name)
+	return l.open()
+}
+
+//Compresses the given finished segment, then prunes old segments, in the background.
+func (l *ConsoleLog) archive(name string) {
+	folder := l.folder
+	go func() {
+		source := apufferi.JoinPath(folder, name)
+		if err := compressConsoleLog(source); err != nil {
+			logging.Exception(fmt.Sprintf("error compressing console log %s", source), err)
+		}
+		pruneConsoleLogs(folder)
+	}()
+}
+
+func compressConsoleLog(source string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(source + ".gz")
+	if err != nil {
+		apufferi.Close(in)
+		return err
+	}
+
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	apufferi.Close(out)
+	apufferi.Close(in)
+
+	if err != nil {
+		_ = os.Remove(source + ".gz")
+		return err
+	}
+	return os.Remove(source)
+}
+
+//Removes the oldest segments past console.logRetention, not counting the current one.
+//The names sort by the time they were started, so no stat is needed.
+func pruneConsoleLogs(folder string) {
+	retention := viper.GetInt("console.logRetention")
+	if retention <= 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+
+	//a segment being compressed exists both with and without .gz, so count it once
+	found := make(map[string]bool)
+	segments := make([]string, 0)
+	for _, file := range files {
+		if file.IsDir() || !IsConsoleLogFile(file.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".gz")
+		if !found[name] {
+			found[name] = true
+			segments = append(segments, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(segments)))
+
+	for i := retention + 1; i < len(segments); i++ {
+		for _, name := range []string{segments[i], segments[i] + ".gz"} {
+			if err = os.Remove(apufferi.JoinPath(folder, name)); err != nil && !os.IsNotExist(err) {
+				logging.Exception("error removing old console log "+name, err)
+			}
+		}
+	}
+}
@@ -19,8 +19,8 @@ package envs
 import (
 	"fmt"
 	"github.com/gorilla/websocket"
-	"github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/cache"
 	"github.com/pufferpanel/pufferd/v2/utils"
 	"github.com/spf13/viper"
 	"io"
@@ -30,10 +30,10 @@ import (
 
 type Environment interface {
 	//Executes a command within the environment.
-	Execute(cmd string, args []string, env map[string]string, callback func(graceful bool)) (stdOut []byte, err error)
+	Execute(cmd string, args []string, env map[string]string, callback ExitCallback) (stdOut []byte, err error)
 
 	//Executes a command within the environment and immediately return
-	ExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error)
+	ExecuteAsync(cmd string, args []string, env map[string]string, callback ExitCallback) (err error)
 
 	//Sends a string to the StdIn of the main program process
 	ExecuteInMainProcess(cmd string) (err error)
@@ -61,7 +61,11 @@ type Environment interface {
 
 	GetConsoleFrom(time int64) (console []string, epoch int64)
 
-	AddListener(ws *websocket.Conn)
+	//Sends console output to the socket. Structured sockets receive lines with their source and stream
+	AddListener(ws *websocket.Conn, structured bool)
+
+	//Stops sending to the socket and closes it
+	RemoveListener(ws *websocket.Conn)
 
 	GetStats() (*pufferd.ServerStats, error)
 
@@ -69,23 +73,34 @@ type Environment interface {
 
 	SendCode(code int) error
 
+	//Suspends the main process without stopping it
+	Pause() error
+
+	//Resumes a main process suspended by Pause
+	Resume() error
+
 	GetBase() *BaseEnvironment
 }
 
 type BaseEnvironment struct {
 	Environment
 	Type              string
-	RootDirectory     string                 `json:"root"`
-	ConsoleBuffer     apufferi.Cache         `json:"-"`
-	WSManager         utils.WebSocketManager `json:"-"`
-	Wait              *sync.WaitGroup        `json:"-"`
-	ExecutionFunction ExecutionFunction      `json:"-"`
-	WaitFunction      func() (err error)     `json:"-"`
+	RootDirectory     string                         `json:"root"`
+	ConsoleBuffer     *cache.ConsoleCache            `json:"-"`
+	WSManager         utils.WebSocketManager         `json:"-"`
+	Wait              *sync.WaitGroup                `json:"-"`
+	ExecutionFunction ExecutionFunction              `json:"-"`
+	WaitFunction      func() (err error)             `json:"-"`
+	ConsoleLines      LineCounter                    `json:"-"`
+	ConsoleLog        *ConsoleLog                    `json:"-"`
+	LineListener      func(line pufferd.ConsoleLine) `json:"-"`
+	consoleSource     string
+	consoleLock       sync.Mutex
 }
 
-type ExecutionFunction func(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error)
+type ExecutionFunction func(cmd string, args []string, env map[string]string, callback ExitCallback) (err error)
 
-func (e *BaseEnvironment) Execute(cmd string, args []string, env map[string]string, callback func(graceful bool)) (stdOut []byte, err error) {
+func (e *BaseEnvironment) Execute(cmd string, args []string, env map[string]string, callback ExitCallback) (stdOut []byte, err error) {
 	stdOut = make([]byte, 0)
 	err = e.ExecuteAsync(cmd, args, env, callback)
 	if err != nil {
@@ -99,7 +114,7 @@ func (e *BaseEnvironment) WaitForMainProcess() (err error) {
 	return e.WaitFunction()
 }
 
-func (e *BaseEnvironment) ExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error) {
+func (e *BaseEnvironment) ExecuteAsync(cmd string, args []string, env map[string]string, callback ExitCallback) (err error) {
 	return e.ExecutionFunction(cmd, args, env, callback)
 }
 
@@ -117,38 +132,68 @@ func (e *BaseEnvironment) GetConsoleFrom(time int64) (console []string, epoch in
 	return
 }
 
-func (e *BaseEnvironment) AddListener(ws *websocket.Conn) {
-	e.WSManager.Register(ws)
+func (e *BaseEnvironment) AddListener(ws *websocket.Conn, structured bool) {
+	e.WSManager.Register(ws, structured)
+}
+
+func (e *BaseEnvironment) RemoveListener(ws *websocket.Conn) {
+	e.WSManager.Unregister(ws)
 }
 
 func (e *BaseEnvironment) DisplayToConsole(daemon bool, msg string, data ...interface{}) {
 	format := msg
-	if daemon {
-		format = "[DAEMON] " + msg
+	if len(data) > 0 {
+		format = fmt.Sprintf(format, data...)
 	}
-	if len(data) == 0 {
-		_, _ = fmt.Fprint(e.ConsoleBuffer, format)
-		_, _ = fmt.Fprint(e.WSManager, format)
-	} else {
-		_, _ = fmt.Fprintf(e.ConsoleBuffer, format, data...)
-		_, _ = fmt.Fprintf(e.WSManager, format, data...)
+	source := e.getConsoleSource()
+	if daemon {
+		source = pufferd.ConsoleSourceDaemon
 	}
+	_, _ = io.WriteString(&consoleWriter{env: e, source: source, stream: pufferd.ConsoleStreamStdout}, format)
 }
 
 func (e *BaseEnvironment) Update() error {
 	return nil
 }
 
+func (e *BaseEnvironment) Pause() error {
+	return pufferd.ErrNotSupported
+}
+
+func (e *BaseEnvironment) Resume() error {
+	return pufferd.ErrNotSupported
+}
+
 func (e *BaseEnvironment) Delete() (err error) {
 	err = os.RemoveAll(e.RootDirectory)
 	return
 }
 
+//Creates a writer for stdout of a process.
+//Output is attributed to the operation running when the writer is created, or the main process otherwise.
 func (e *BaseEnvironment) CreateWrapper() io.Writer {
-	if viper.GetBool("console.forward") {
-		return io.MultiWriter(os.Stdout, e.ConsoleBuffer, e.WSManager)
+	return &consoleWriter{env: e, source: e.getConsoleSource(), stream: pufferd.ConsoleStreamStdout, forward: viper.GetBool("console.forward")}
+}
+
+//Creates a writer for stderr of a process.
+func (e *BaseEnvironment) CreateErrorWrapper() io.Writer {
+	return &consoleWriter{env: e, source: e.getConsoleSource(), stream: pufferd.ConsoleStreamStderr, forward: viper.GetBool("console.forward")}
+}
+
+//Attributes console output to the given operation, until it is set back to an empty string.
+func (e *BaseEnvironment) SetConsoleSource(operation string) {
+	e.consoleLock.Lock()
+	defer e.consoleLock.Unlock()
+	e.consoleSource = operation
+}
+
+func (e *BaseEnvironment) getConsoleSource() string {
+	e.consoleLock.Lock()
+	defer e.consoleLock.Unlock()
+	if e.consoleSource == "" {
+		return pufferd.ConsoleSourceProcess
 	}
-	return io.MultiWriter(e.ConsoleBuffer, e.WSManager)
+	return e.consoleSource
 }
 
 func (e *BaseEnvironment) GetBase() *BaseEnvironment {
@@ -0,0 +1,55 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package envs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"os"
+	"syscall"
+)
+
+//Called when the main process of an environment exits.
+type ExitCallback func(status pufferd.ExitStatus)
+
+//Creates the exit status for a process which has finished running.
+//A nil state means the process could not be waited on, and is never treated as graceful.
+func CreateExitStatus(state *os.ProcessState) pufferd.ExitStatus {
+	if state == nil {
+		return pufferd.ExitStatus{ExitCode: -1}
+	}
+
+	status := pufferd.ExitStatus{
+		Graceful: state.Success(),
+		ExitCode: state.ExitCode(),
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.Signal = ws.Signal().String()
+	}
+	return status
+}
+
+//Creates the exit status from a shell style exit code, where codes above 128 mean the process was killed by a signal.
+func CreateExitStatusFromCode(code int) pufferd.ExitStatus {
+	status := pufferd.ExitStatus{
+		Graceful: code == 0,
+		ExitCode: code,
+	}
+	if code > 128 {
+		status.Signal = syscall.Signal(code - 128).String()
+	}
+	return status
+}
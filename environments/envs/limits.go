@@ -0,0 +1,33 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package envs
+
+//Standard and tty servers need cgroup v2 on Linux to apply these, and will not start if they cannot be applied.
+type ResourceLimits struct {
+	//Memory limit in megabytes
+	Memory int64 `json:"memory,omitempty"`
+	//CPU limit as a percentage of a single core, so 200 allows two full cores
+	CPU int64 `json:"cpu,omitempty"`
+	//Maximum number of processes and threads
+	Pids int64 `json:"pids,omitempty"`
+	//Relative IO weight, from 1 to 10000. Docker servers scale this to the blkio range of 10 to 1000
+	IOWeight int64 `json:"ioWeight,omitempty"`
+}
+
+func (l ResourceLimits) IsEmpty() bool {
+	return l.Memory <= 0 && l.CPU <= 0 && l.Pids <= 0 && l.IOWeight <= 0
+}
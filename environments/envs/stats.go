@@ -0,0 +1,143 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package envs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/process"
+	"sync"
+	"time"
+)
+
+//How long CPU usage is measured over when there is no recent sample to measure from
+const cpuSampleWindow = 500 * time.Millisecond
+
+//How old the previous sample can be for CPU usage to be measured from it
+const cpuSampleMaxAge = 5 * time.Second
+
+//Samples the stats of a process and everything it started.
+//CPU usage is worked out from the CPU time used since the previous sample. When there is no previous sample,
+//or it is older than cpuSampleMaxAge, CPU time is read twice cpuSampleWindow apart instead, so the usage
+//does not depend on how often the process is sampled. Samples taken closer together than that report the last usage.
+type ProcessSampler struct {
+	pid      int
+	cpuTimes map[int32]float64
+	lastTime time.Time
+	lastCpu  float64
+	locker   sync.Mutex
+}
+
+//Gets the current stats for the process.
+//The memory limit is in bytes, with 0 meaning the host's total memory.
+//Network usage cannot be told apart from the rest of the host, so it is left empty.
+func (s *ProcessSampler) Sample(pid int, memoryLimit uint64) (*pufferd.ServerStats, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	pr, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+
+	if s.pid != pid {
+		s.pid = pid
+		s.cpuTimes = nil
+		s.lastTime = time.Time{}
+		s.lastCpu = 0
+	}
+
+	stats := &pufferd.ServerStats{
+		MemoryLimit: memoryLimit,
+	}
+
+	if stats.MemoryLimit == 0 {
+		if vm, err := mem.VirtualMemory(); err == nil {
+			stats.MemoryLimit = vm.Total
+		}
+	}
+
+	if created, err := pr.CreateTime(); err == nil {
+		stats.Uptime = time.Now().Unix() - created/1000
+	}
+
+	if s.lastTime.IsZero() || time.Since(s.lastTime) > cpuSampleMaxAge {
+		s.cpuTimes = getCpuTimes(getProcessTree(pr))
+		s.lastTime = time.Now()
+		time.Sleep(cpuSampleWindow)
+	}
+
+	now := time.Now()
+	cpuTimes := make(map[int32]float64)
+	used := 0.0
+
+	for _, v := range getProcessTree(pr) {
+		stats.Pids++
+		if memory, err := v.MemoryInfo(); err == nil {
+			stats.Memory += memory.RSS
+		}
+		if io, err := v.IOCounters(); err == nil {
+			stats.BlockRead += io.ReadBytes
+			stats.BlockWrite += io.WriteBytes
+		}
+		if times, err := v.Times(); err == nil {
+			total := times.User + times.System
+			cpuTimes[v.Pid] = total
+			if last, exists := s.cpuTimes[v.Pid]; exists {
+				used += total - last
+			} else {
+				//started since the last sample
+				used += total
+			}
+		}
+	}
+
+	//too little time has passed to measure, so the last usage is kept
+	if now.Sub(s.lastTime) < cpuSampleWindow {
+		stats.Cpu = s.lastCpu
+		return stats, nil
+	}
+
+	elapsed := now.Sub(s.lastTime).Seconds()
+	if used > 0 {
+		stats.Cpu = used / elapsed * 100
+	}
+	s.cpuTimes = cpuTimes
+	s.lastTime = now
+	s.lastCpu = stats.Cpu
+
+	return stats, nil
+}
+
+func getCpuTimes(processes []*process.Process) map[int32]float64 {
+	result := make(map[int32]float64)
+	for _, v := range processes {
+		if times, err := v.Times(); err == nil {
+			result[v.Pid] = times.User + times.System
+		}
+	}
+	return result
+}
+
+func getProcessTree(pr *process.Process) []*process.Process {
+	result := []*process.Process{pr}
+	children, _ := pr.Children()
+	for _, v := range children {
+		result = append(result, getProcessTree(v)...)
+	}
+	return result
+}
@@ -18,6 +18,7 @@ package docker
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/docker/docker/api/types"
@@ -26,16 +27,20 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
 	"github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/pufferd/v2"
 	"github.com/pufferpanel/pufferd/v2/environments/envs"
 	"io"
-	"io/ioutil"
 	"os"
 	"runtime"
-	"syscall"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,12 +53,37 @@ type docker struct {
 	Network     string            `json:"networkName,omitempty"`
 	Ports       []string          `json:"portBindings,omitempty"`
 
+	Limits envs.ResourceLimits `json:"limits,omitempty"`
+	//Swap in megabytes available on top of the memory limit, or -1 for unlimited
+	Swap             int64             `json:"swap,omitempty"`
+	CPUShares        int64             `json:"cpuShares,omitempty"`
+	CPUSet           string            `json:"cpuSet,omitempty"`
+	Ulimits          []Ulimit          `json:"ulimits,omitempty"`
+	ReadOnly         bool              `json:"readOnly,omitempty"`
+	Tmpfs            map[string]string `json:"tmpfs,omitempty"`
+	Capabilities     []string          `json:"capabilities,omitempty"`
+	DropCapabilities []string          `json:"dropCapabilities,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	//Only "no" is supported. The daemon stops the container once it detaches from it, and restarts servers itself
+	//with run.autoRestartFromCrash and run.autoRestartFromGraceful, so docker restarting it would fight the daemon
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+
 	connection       types.HijackedResponse
 	cli              *client.Client
-	downloadingImage bool
+	downloadingImage int32
+	stats            statsSampler
+}
+
+//Label holding a hash of the settings the container was created with
+const configLabel = "pufferd.config"
+
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
 }
 
-func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) error {
+func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]string, callback envs.ExitCallback) error {
 	running, err := d.IsRunning()
 	if err != nil {
 		return err
@@ -64,26 +94,19 @@ func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]st
 
 	d.Wait.Wait()
 
-	if d.downloadingImage {
+	if atomic.LoadInt32(&d.downloadingImage) == 1 {
 		return pufferd.ErrImageDownloading
 	}
 
 	dockerClient, err := d.getClient()
-	ctx := context.Background()
-
-	//TODO: This logic may not work anymore, it's complicated to use an existing container with install/uninstall
-	exists, err := d.doesContainerExist(dockerClient, ctx)
-
 	if err != nil {
 		return err
 	}
+	ctx := context.Background()
 
-	//container does not exist
-	if !exists {
-		err = d.createContainer(dockerClient, ctx, cmd, args, env, d.RootDirectory)
-		if err != nil {
-			return err
-		}
+	err = d.ensureContainer(dockerClient, ctx, cmd, args, env)
+	if err != nil {
+		return err
 	}
 
 	config := types.ContainerAttachOptions{
@@ -98,25 +121,44 @@ func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]st
 		return err
 	}
 
+	//listen for the exit before starting, so a container which exits immediately is not missed
+	exitCh, exitErrCh := dockerClient.ContainerWait(ctx, d.ContainerId, container.WaitConditionNextExit)
+
 	d.Wait.Add(1)
 
 	go func() {
 		defer d.connection.Close()
 		wrapper := d.CreateWrapper()
 		_, _ = io.Copy(wrapper, d.connection.Reader)
+		d.stats.Stop()
 		c, _ := d.getClient()
-		err = c.ContainerStop(context.Background(), d.ContainerId, nil)
-		d.Wait.Done()
+
+		err := c.ContainerStop(context.Background(), d.ContainerId, nil)
 		if err != nil {
 			logging.Exception("Error stopping container "+d.ContainerId, err)
 		}
+
+		status := pufferd.ExitStatus{ExitCode: -1}
+		select {
+		case result := <-exitCh:
+			status = envs.CreateExitStatusFromCode(int(result.StatusCode))
+		case err := <-exitErrCh:
+			logging.Exception("Error getting exit code of container "+d.ContainerId, err)
+		}
+
+		info, err := c.ContainerInspect(context.Background(), d.ContainerId)
+		if err == nil && info.State != nil && info.State.OOMKilled {
+			status.OOMKilled = true
+			status.Graceful = false
+		}
+
 		if callback != nil {
-			callback(err == nil)
+			callback(status)
 		}
+		d.Wait.Done()
 	}()
 
-	startOpts := types.ContainerStartOptions{
-	}
+	startOpts := types.ContainerStartOptions{}
 
 	err = dockerClient.ContainerStart(ctx, d.ContainerId, startOpts)
 	if err != nil {
@@ -125,6 +167,69 @@ func (d *docker) dockerExecuteAsync(cmd string, args []string, env map[string]st
 	return err
 }
 
+//Runs the command in a new container which is removed once it exits, leaving the server's own container alone.
+//This is used for installing, uninstalling and any other command operations.
+func (d *docker) Execute(cmd string, args []string, env map[string]string, callback envs.ExitCallback) (stdOut []byte, err error) {
+	stdOut = make([]byte, 0)
+
+	dockerClient, err := d.getClient()
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+
+	err = d.pullImage(dockerClient, ctx, false)
+	if err != nil {
+		return
+	}
+
+	config, hostConfig, err := d.getContainerConfig(cmd, args, env)
+	if err != nil {
+		return
+	}
+	config.AttachStdin = false
+	config.OpenStdin = false
+	hostConfig.AutoRemove = true
+	hostConfig.PortBindings = nat.PortMap{}
+
+	name := fmt.Sprintf("%s-%d", d.ContainerId, time.Now().UnixNano())
+	logging.Debug("Creating container %s", name)
+	_, err = dockerClient.ContainerCreate(ctx, config, hostConfig, &network.NetworkingConfig{}, name)
+	if err != nil {
+		return
+	}
+
+	connection, err := dockerClient.ContainerAttach(ctx, name, types.ContainerAttachOptions{Stdout: true, Stderr: true, Stream: true})
+	if err != nil {
+		_ = dockerClient.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true})
+		return
+	}
+	defer connection.Close()
+
+	exitCh, exitErrCh := dockerClient.ContainerWait(ctx, name, container.WaitConditionNextExit)
+
+	err = dockerClient.ContainerStart(ctx, name, types.ContainerStartOptions{})
+	if err != nil {
+		_ = dockerClient.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true})
+		return
+	}
+
+	_, _ = io.Copy(d.CreateWrapper(), connection.Reader)
+
+	status := pufferd.ExitStatus{ExitCode: -1}
+	select {
+	case result := <-exitCh:
+		status = envs.CreateExitStatusFromCode(int(result.StatusCode))
+	case err := <-exitErrCh:
+		logging.Exception("Error getting exit code of container "+name, err)
+	}
+
+	if callback != nil {
+		callback(status)
+	}
+	return
+}
+
 func (d *docker) ExecuteInMainProcess(cmd string) (err error) {
 	running, err := d.IsRunning()
 	if err != nil {
@@ -174,6 +279,46 @@ func (d *docker) Create() error {
 	return err
 }
 
+//Downloads the latest version of the image and removes the container, so the next start recreates it from the new image.
+//A running container is left alone and picks up the new image when it is next started.
+func (d *docker) Update() error {
+	dockerClient, err := d.getClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	err = d.pullImage(dockerClient, ctx, true)
+	if err != nil {
+		return err
+	}
+
+	running, err := d.IsRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		d.DisplayToConsole(true, "Image updated, the server will use it when next started\n")
+		return nil
+	}
+
+	return d.removeContainer(dockerClient, ctx)
+}
+
+func (d *docker) Delete() error {
+	dockerClient, err := d.getClient()
+	if err != nil {
+		return err
+	}
+
+	err = d.removeContainer(dockerClient, context.Background())
+	if err != nil {
+		return err
+	}
+
+	return d.BaseEnvironment.Delete()
+}
+
 func (d *docker) IsRunning() (bool, error) {
 	dockerClient, err := d.getClient()
 	if err != nil {
@@ -210,27 +355,40 @@ func (d *docker) GetStats() (*pufferd.ServerStats, error) {
 		return nil, err
 	}
 
-	ctx := context.Background()
-	res, err := dockerClient.ContainerStats(ctx, d.ContainerId, false)
-	defer func() {
-		if res.Body != nil {
-			apufferi.Close(res.Body)
-		}
-	}()
+	data, err := d.stats.Sample(dockerClient, d.ContainerId)
 	if err != nil {
 		return nil, err
 	}
 
-	data := &types.StatsJSON{}
-	err = json.NewDecoder(res.Body).Decode(&data)
-	if err != nil {
-		return nil, err
+	stats := &pufferd.ServerStats{
+		Cpu:         calculateCPUPercent(data),
+		Memory:      calculateMemory(data),
+		MemoryLimit: data.MemoryStats.Limit,
+		Pids:        data.PidsStats.Current,
+	}
+
+	for _, v := range data.Networks {
+		stats.NetworkRx += v.RxBytes
+		stats.NetworkTx += v.TxBytes
+	}
+
+	for _, v := range data.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(v.Op) {
+		case "read":
+			stats.BlockRead += v.Value
+		case "write":
+			stats.BlockWrite += v.Value
+		}
+	}
+
+	info, err := dockerClient.ContainerInspect(context.Background(), d.ContainerId)
+	if err == nil && info.State != nil {
+		if started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil {
+			stats.Uptime = int64(time.Since(started).Seconds())
+		}
 	}
 
-	return &pufferd.ServerStats{
-		Memory: calculateMemoryPercent(data),
-		Cpu:    calculateCPUPercent(data),
-	}, nil
+	return stats, nil
 }
 
 func (d *docker) WaitForMainProcess() error {
@@ -266,26 +424,27 @@ func (d *docker) getClient() (*client.Client, error) {
 	return d.cli, err
 }
 
-func (d *docker) doesContainerExist(client *client.Client, ctx context.Context) (bool, error) {
-	opts := types.ContainerListOptions{
-		Filters: filters.NewArgs(),
+func (d *docker) doesContainerExist(dockerClient *client.Client, ctx context.Context) (bool, error) {
+	_, err := dockerClient.ContainerInspect(ctx, d.ContainerId)
+	if client.IsErrNotFound(err) {
+		logging.Debug("Does container (%s) exist?: %t", d.ContainerId, false)
+		return false, nil
 	}
+	logging.Debug("Does container (%s) exist?: %t", d.ContainerId, err == nil)
+	return err == nil, err
+}
 
-	opts.All = true
-	opts.Filters.Add("name", d.ContainerId)
-
-	existingContainers, err := client.ContainerList(ctx, opts)
-
-	logging.Debug("Does container (%s) exist?: %t", d.ContainerId, len(existingContainers) > 0)
-
-	if len(existingContainers) == 0 {
-		return false, err
-	} else {
-		return true, err
+func (d *docker) removeContainer(dockerClient *client.Client, ctx context.Context) error {
+	err := dockerClient.ContainerRemove(ctx, d.ContainerId, types.ContainerRemoveOptions{Force: true})
+	if client.IsErrNotFound(err) {
+		return nil
 	}
+	return err
 }
 
-func (d *docker) pullImage(client *client.Client, ctx context.Context, force bool) error {
+//Makes sure the image is downloaded, pulling it again if forced to.
+//Only one pull runs at a time, any others fail with ErrImageDownloading.
+func (d *docker) pullImage(dockerClient *client.Client, ctx context.Context, force bool) error {
 	exists := false
 
 	opts := types.ImageListOptions{
@@ -293,7 +452,7 @@ func (d *docker) pullImage(client *client.Client, ctx context.Context, force boo
 		Filters: filters.NewArgs(),
 	}
 	opts.Filters.Add("reference", d.ImageName)
-	images, err := client.ImageList(ctx, opts)
+	images, err := dockerClient.ImageList(ctx, opts)
 
 	if err != nil {
 		return err
@@ -309,34 +468,118 @@ func (d *docker) pullImage(client *client.Client, ctx context.Context, force boo
 		return nil
 	}
 
+	if !atomic.CompareAndSwapInt32(&d.downloadingImage, 0, 1) {
+		return pufferd.ErrImageDownloading
+	}
+	defer atomic.StoreInt32(&d.downloadingImage, 0)
+
 	op := types.ImagePullOptions{}
 
 	logging.Debug("Downloading image %v", d.ImageName)
 	d.DisplayToConsole(true, "Downloading image for container, please wait\n")
 
-	d.downloadingImage = true
-
-	r, err := client.ImagePull(ctx, d.ImageName, op)
+	r, err := dockerClient.ImagePull(ctx, d.ImageName, op)
+	if err != nil {
+		return err
+	}
 	defer apufferi.Close(r)
+
+	err = d.displayPullProgress(r)
 	if err != nil {
+		d.DisplayToConsole(true, "Failed to download image: %s\n", err.Error())
 		return err
 	}
-	_, err = io.Copy(ioutil.Discard, r)
 
-	d.downloadingImage = false
 	logging.Debug("Downloaded image %v", d.ImageName)
 	d.DisplayToConsole(true, "Downloaded image for container\n")
-	return err
+	return nil
 }
 
-func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd string, args []string, env map[string]string, root string) error {
-	logging.Debug("Creating container")
-	containerRoot := "/var/lib/pufferd/server/"
-	err := d.pullImage(client, ctx, false)
+//Writes the progress messages docker sends while pulling an image to the console.
+//Download and extract progress for each layer is only shown every few seconds to keep the console readable.
+func (d *docker) displayPullProgress(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	lastProgress := make(map[string]time.Time)
+
+	for {
+		var msg jsonmessage.JSONMessage
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if msg.Progress != nil && msg.Progress.Total > 0 {
+			if time.Since(lastProgress[msg.ID]) < 2*time.Second {
+				continue
+			}
+			lastProgress[msg.ID] = time.Now()
+			d.DisplayToConsole(true, "%s: %s %d%%\n", msg.ID, msg.Status, msg.Progress.Current*100/msg.Progress.Total)
+		} else if msg.ID != "" {
+			d.DisplayToConsole(true, "%s: %s\n", msg.ID, msg.Status)
+		} else if msg.Status != "" {
+			d.DisplayToConsole(true, "%s\n", msg.Status)
+		}
+	}
+}
+
+//Creates the server's container, or replaces the existing one if it was made from a different image or configuration.
+func (d *docker) ensureContainer(dockerClient *client.Client, ctx context.Context, cmd string, args []string, env map[string]string) error {
+	err := d.pullImage(dockerClient, ctx, false)
+	if err != nil {
+		return err
+	}
+
+	config, hostConfig, err := d.getContainerConfig(cmd, args, env)
+	if err != nil {
+		return err
+	}
+
+	image, _, err := dockerClient.ImageInspectWithRaw(ctx, d.ImageName)
+	if err != nil {
+		return err
+	}
 
+	data, err := json.Marshal([]interface{}{config, hostConfig})
 	if err != nil {
 		return err
 	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	config.Labels[configLabel] = hash
+
+	existing, err := dockerClient.ContainerInspect(ctx, d.ContainerId)
+	if err == nil {
+		if existing.Image == image.ID && existing.Config != nil && existing.Config.Labels[configLabel] == hash {
+			logging.Debug("Reusing container %s", d.ContainerId)
+			return nil
+		}
+
+		logging.Debug("Container %s is out of date, recreating", d.ContainerId)
+		err = dockerClient.ContainerRemove(ctx, d.ContainerId, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return err
+		}
+	} else if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	logging.Debug("Creating container %s", d.ContainerId)
+	_, err = dockerClient.ContainerCreate(ctx, config, hostConfig, &network.NetworkingConfig{}, d.ContainerId)
+	return err
+}
+
+//Builds the container definition for running the command with this environment's settings.
+func (d *docker) getContainerConfig(cmd string, args []string, env map[string]string) (*container.Config, *container.HostConfig, error) {
+	if d.RestartPolicy != "" && d.RestartPolicy != "no" {
+		return nil, nil, pufferd.ErrRestartPolicyNotSupported
+	}
+
+	containerRoot := "/var/lib/pufferd/server/"
 
 	cmdSlice := strslice.StrSlice{}
 
@@ -352,6 +595,13 @@ func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd
 	for k, v := range env {
 		newEnv = append(newEnv, fmt.Sprintf("%s=%s", k, v))
 	}
+	//keep the order stable, so unchanged settings give the same container
+	sort.Strings(newEnv)
+
+	labels := make(map[string]string)
+	for k, v := range d.Labels {
+		labels[k] = v
+	}
 
 	config := &container.Config{
 		AttachStderr:    true,
@@ -362,8 +612,9 @@ func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd
 		NetworkDisabled: false,
 		Cmd:             cmdSlice,
 		Image:           d.ImageName,
-		WorkingDir:      root,
+		WorkingDir:      containerRoot,
 		Env:             newEnv,
+		Labels:          labels,
 	}
 
 	if runtime.GOOS == "linux" {
@@ -371,29 +622,78 @@ func (d *docker) createContainer(client *client.Client, ctx context.Context, cmd
 	}
 
 	hostConfig := &container.HostConfig{
-		AutoRemove:   true,
-		NetworkMode:  container.NetworkMode(d.NetworkMode),
-		Resources:    container.Resources{},
-		Binds:        []string{root + ":" + containerRoot},
-		PortBindings: nat.PortMap{},
+		NetworkMode:    container.NetworkMode(d.NetworkMode),
+		Resources:      d.getResources(),
+		Binds:          []string{d.RootDirectory + ":" + containerRoot},
+		PortBindings:   nat.PortMap{},
+		ReadonlyRootfs: d.ReadOnly,
+		Tmpfs:          d.Tmpfs,
+		CapAdd:         d.Capabilities,
+		CapDrop:        d.DropCapabilities,
 	}
 
-	config.WorkingDir = containerRoot
-
+	binds := make([]string, 0, len(d.Binds))
 	for k, v := range d.Binds {
-		hostConfig.Binds = append(hostConfig.Binds, k+":"+v)
+		binds = append(binds, k+":"+v)
 	}
-
-	networkConfig := &network.NetworkingConfig{}
+	sort.Strings(binds)
+	hostConfig.Binds = append(hostConfig.Binds, binds...)
 
 	_, bindings, err := nat.ParsePortSpecs(d.Ports)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	hostConfig.PortBindings = bindings
 
-	_, err = client.ContainerCreate(ctx, config, hostConfig, networkConfig, d.ContainerId)
-	return err
+	return config, hostConfig, nil
+}
+
+//Converts the configured limits into the resources docker applies to the container.
+func (d *docker) getResources() container.Resources {
+	resources := container.Resources{
+		CPUShares:  d.CPUShares,
+		CpusetCpus: d.CPUSet,
+	}
+
+	if d.Limits.Memory > 0 {
+		resources.Memory = d.Limits.Memory * 1024 * 1024
+		if d.Swap < 0 {
+			resources.MemorySwap = -1
+		} else {
+			resources.MemorySwap = (d.Limits.Memory + d.Swap) * 1024 * 1024
+		}
+	}
+
+	if d.Limits.CPU > 0 {
+		resources.CPUPeriod = 100000
+		resources.CPUQuota = d.Limits.CPU * 1000
+	}
+
+	if d.Limits.Pids > 0 {
+		pids := d.Limits.Pids
+		resources.PidsLimit = &pids
+	}
+
+	if d.Limits.IOWeight > 0 {
+		resources.BlkioWeight = toBlkioWeight(d.Limits.IOWeight)
+	}
+
+	for _, v := range d.Ulimits {
+		resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: v.Name, Soft: v.Soft, Hard: v.Hard})
+	}
+
+	return resources
+}
+
+//Scales a cgroup v2 IO weight, from 1 to 10000, to the blkio weight docker takes, from 10 to 1000.
+//This is the inverse of how runc converts blkio weights on cgroup v2 hosts, so both environments get the same weight.
+func toBlkioWeight(weight int64) uint16 {
+	if weight < 1 {
+		weight = 1
+	} else if weight > 10000 {
+		weight = 10000
+	}
+	return uint16(10 + (weight-1)*990/9999)
 }
 
 func (d *docker) SendCode(code int) error {
@@ -410,25 +710,60 @@ func (d *docker) SendCode(code int) error {
 	}
 
 	ctx := context.Background()
-	return dockerClient.ContainerKill(ctx, d.ContainerId, syscall.Signal(code).String())
+	return dockerClient.ContainerKill(ctx, d.ContainerId, strconv.Itoa(code))
+}
+
+func (d *docker) Pause() error {
+	running, err := d.IsRunning()
+
+	if err != nil || !running {
+		return err
+	}
+
+	dockerClient, err := d.getClient()
+
+	if err != nil {
+		return err
+	}
+
+	return dockerClient.ContainerPause(context.Background(), d.ContainerId)
 }
 
+func (d *docker) Resume() error {
+	dockerClient, err := d.getClient()
+
+	if err != nil {
+		return err
+	}
+
+	return dockerClient.ContainerUnpause(context.Background(), d.ContainerId)
+}
+
+//Calculates the CPU usage as a percentage of a single core, the same way the docker cli does.
 func calculateCPUPercent(v *types.StatsJSON) float64 {
-	// Max number of 100ns intervals between the previous time read and now
-	possIntervals := uint64(v.Read.Sub(v.PreRead).Nanoseconds()) // Start with number of ns intervals
-	possIntervals /= 100                                         // Convert to number of 100ns intervals
-	//possIntervals *= uint64(v.NumProcs)                          // Multiple by the number of processors
+	cpuDelta := float64(v.CPUStats.CPUUsage.TotalUsage) - float64(v.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(v.CPUStats.SystemUsage) - float64(v.PreCPUStats.SystemUsage)
 
-	// Intervals used
-	intervalsUsed := v.CPUStats.CPUUsage.TotalUsage - v.PreCPUStats.CPUUsage.TotalUsage
+	cpus := float64(v.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(v.CPUStats.CPUUsage.PercpuUsage))
+	}
 
-	// Percentage avoiding divide-by-zero
-	if possIntervals > 0 {
-		return float64(intervalsUsed) / float64(possIntervals)
+	if cpuDelta > 0 && systemDelta > 0 {
+		return cpuDelta / systemDelta * cpus * 100
 	}
-	return 0.00
+	return 0
 }
 
-func calculateMemoryPercent(v *types.StatsJSON) float64 {
-	return float64(v.MemoryStats.Usage) / (1024 * 1024) //convert from bytes to MB
+//Calculates the memory in use, leaving out the page cache the same way the docker cli does.
+func calculateMemory(v *types.StatsJSON) uint64 {
+	cache := v.MemoryStats.Stats["cache"]
+	if cache == 0 {
+		//cgroups v2 does not report cache
+		cache = v.MemoryStats.Stats["inactive_file"]
+	}
+	if cache > v.MemoryStats.Usage {
+		return 0
+	}
+	return v.MemoryStats.Usage - cache
 }
@@ -0,0 +1,137 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pufferpanel/pufferd/v2"
+	"io"
+	"sync"
+	"time"
+)
+
+//How long to wait for docker to send the first stats once the stream is opened
+const statsTimeout = 10 * time.Second
+
+//Keeps a stream of the container's stats open, so they can be read without waiting on docker.
+//Each request for stats without a stream waits for docker to take two samples, around a second apart, to work out
+//the CPU usage. The stream sends a sample about once a second, so the newest one is kept and returned instead.
+//Only the first call after the stream is opened waits, until the first sample with CPU usage arrives.
+type statsSampler struct {
+	latest *types.StatsJSON
+	ready  chan struct{}
+	cancel context.CancelFunc
+	locker sync.Mutex
+}
+
+//Gets the newest stats for the container, opening the stream if it is not already open.
+func (s *statsSampler) Sample(dockerClient *client.Client, containerId string) (*types.StatsJSON, error) {
+	s.locker.Lock()
+	if s.ready == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := dockerClient.ContainerStats(ctx, containerId, true)
+		if err != nil {
+			cancel()
+			s.locker.Unlock()
+			return nil, err
+		}
+		s.ready = make(chan struct{})
+		s.cancel = cancel
+		go s.read(res.Body, s.ready)
+	}
+	ready := s.ready
+	s.locker.Unlock()
+
+	select {
+	case <-ready:
+	case <-time.After(statsTimeout):
+		return nil, pufferd.ErrStatsTimeout
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.ready != ready || s.latest == nil {
+		//the stream closed, which docker does once the container stops
+		return nil, pufferd.ErrServerOffline
+	}
+	return s.latest, nil
+}
+
+//Closes the stream, so the next sample opens a new one.
+func (s *statsSampler) Stop() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.reset()
+}
+
+//Keeps the newest sample from the stream until it closes.
+//Ready is closed once the first sample with CPU usage arrives, or the stream closes.
+func (s *statsSampler) read(body io.ReadCloser, ready chan struct{}) {
+	defer body.Close()
+
+	received := false
+	decoder := json.NewDecoder(body)
+	for {
+		data := &types.StatsJSON{}
+		if decoder.Decode(data) != nil {
+			break
+		}
+		//the first sample has nothing to work out CPU usage from
+		if data.PreCPUStats.SystemUsage == 0 {
+			continue
+		}
+
+		s.locker.Lock()
+		current := s.ready == ready
+		if current {
+			s.latest = data
+		}
+		s.locker.Unlock()
+		if !current {
+			//stopped, and a new stream may already be open
+			break
+		}
+
+		if !received {
+			received = true
+			close(ready)
+		}
+	}
+
+	s.locker.Lock()
+	if s.ready == ready {
+		s.cancel()
+		s.reset()
+	}
+	s.locker.Unlock()
+	if !received {
+		close(ready)
+	}
+}
+
+//Callers must hold locker.
+func (s *statsSampler) reset() {
+	s.latest = nil
+	s.ready = nil
+	s.cancel = nil
+}
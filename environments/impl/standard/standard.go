@@ -18,8 +18,8 @@ package standard
 
 import (
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/environments/cgroups"
 	"github.com/pufferpanel/pufferd/v2/environments/envs"
-	"github.com/spf13/cast"
 	"io"
 	"os"
 	"os/exec"
@@ -29,17 +29,23 @@ import (
 
 	"fmt"
 	"github.com/pufferpanel/apufferi/v4/logging"
-	"github.com/shirou/gopsutil/process"
 	"strings"
+	"sync"
 )
 
 type standard struct {
 	*envs.BaseEnvironment
+	Limits      envs.ResourceLimits `json:"limits,omitempty"`
+	id          string
 	mainProcess *exec.Cmd
 	stdInWriter io.Writer
+	//Guards mainProcess and stdInWriter, which are cleared by the goroutine waiting on the process
+	processLock sync.Mutex
+	cgroup      *cgroups.Group
+	sampler     envs.ProcessSampler
 }
 
-func (s *standard) standardExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error) {
+func (s *standard) standardExecuteAsync(cmd string, args []string, env map[string]string, callback envs.ExitCallback) (err error) {
 	running, err := s.IsRunning()
 	if err != nil {
 		return
@@ -49,59 +55,98 @@ func (s *standard) standardExecuteAsync(cmd string, args []string, env map[strin
 		return
 	}
 	s.Wait.Wait()
-	s.Wait.Add(1)
-	s.mainProcess = exec.Command(cmd, args...)
-	s.mainProcess.Dir = s.RootDirectory
-	s.mainProcess.Env = append(os.Environ(), "HOME="+s.RootDirectory)
+	process := exec.Command(cmd, args...)
+	process.Dir = s.RootDirectory
+	process.Env = append(os.Environ(), "HOME="+s.RootDirectory)
 	for k, v := range env {
-		s.mainProcess.Env = append(s.mainProcess.Env, fmt.Sprintf("%s=%s", k, v))
+		process.Env = append(process.Env, fmt.Sprintf("%s=%s", k, v))
 	}
-	wrapper := s.CreateWrapper()
-	s.mainProcess.Stdout = wrapper
-	s.mainProcess.Stderr = wrapper
-	pipe, err := s.mainProcess.StdinPipe()
+	process.Stdout = s.CreateWrapper()
+	process.Stderr = s.CreateErrorWrapper()
+	pipe, err := process.StdinPipe()
 	if err != nil {
 		return
 	}
-	s.stdInWriter = pipe
-	logging.Debug("Starting process: %s %s", s.mainProcess.Path, strings.Join(s.mainProcess.Args[1:], " "))
-	err = s.mainProcess.Start()
+
+	if !s.Limits.IsEmpty() {
+		s.cgroup, err = cgroups.Create(s.id, s.Limits)
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error applying resource limits for server %s", s.id), err)
+			s.DisplayToConsole(true, "Failed to apply resource limits\n")
+			return
+		}
+	}
+
+	s.Wait.Add(1)
+	logging.Debug("Starting process: %s %s", process.Path, strings.Join(process.Args[1:], " "))
+	err = process.Start()
 	if err != nil && err.Error() != "exit status 1" {
+		if s.cgroup != nil {
+			_ = s.cgroup.Close()
+			s.cgroup = nil
+		}
+		s.Wait.Done()
 		return
 	} else {
-		logging.Debug("Process started (%d)", s.mainProcess.Process.Pid)
+		logging.Debug("Process started (%d)", process.Process.Pid)
+	}
+
+	if s.cgroup != nil {
+		err = s.cgroup.Started(s, process.Process.Pid)
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error applying resource limits for server %s", s.id), err)
+			s.DisplayToConsole(true, "Failed to apply resource limits\n")
+			_ = process.Process.Kill()
+			_ = process.Wait()
+			_ = s.cgroup.Close()
+			s.cgroup = nil
+			s.Wait.Done()
+			return
+		}
 	}
 
-	go s.handleClose(callback)
+	s.processLock.Lock()
+	s.mainProcess = process
+	s.stdInWriter = pipe
+	s.processLock.Unlock()
+
+	go s.handleClose(process, callback)
 	return
 }
 
 func (s *standard) ExecuteInMainProcess(cmd string) (err error) {
-	running, err := s.IsRunning()
-	if err != nil {
-		return err
-	}
+	s.processLock.Lock()
+	running := s.isRunning()
+	stdIn := s.stdInWriter
+	s.processLock.Unlock()
+
 	if !running {
 		err = pufferd.ErrServerOffline
 		return
 	}
-	stdIn := s.stdInWriter
 	_, err = io.WriteString(stdIn, cmd+"\n")
 	return
 }
 
 func (s *standard) Kill() (err error) {
-	running, err := s.IsRunning()
-	if err != nil {
-		return err
-	}
-	if !running {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	if !s.isRunning() {
 		return
 	}
 	return s.mainProcess.Process.Kill()
 }
 
 func (s *standard) IsRunning() (isRunning bool, err error) {
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
+
+	return s.isRunning(), nil
+}
+
+//Callers must hold processLock.
+func (s *standard) isRunning() (isRunning bool) {
 	isRunning = s.mainProcess != nil && s.mainProcess.Process != nil
 	if isRunning {
 		pr, pErr := os.FindProcess(s.mainProcess.Process.Pid)
@@ -115,25 +160,15 @@ func (s *standard) IsRunning() (isRunning bool, err error) {
 }
 
 func (s *standard) GetStats() (*pufferd.ServerStats, error) {
-	running, err := s.IsRunning()
-	if err != nil {
-		return nil, err
-	}
-	if !running {
+	s.processLock.Lock()
+	if !s.isRunning() {
+		s.processLock.Unlock()
 		return nil, pufferd.ErrServerOffline
 	}
-	pr, err := process.NewProcess(int32(s.mainProcess.Process.Pid))
-	if err != nil {
-		return nil, err
-	}
+	pid := s.mainProcess.Process.Pid
+	s.processLock.Unlock()
 
-	memMap, _ := pr.MemoryInfo()
-	cpu, _ := pr.Percent(time.Second * 1)
-
-	return &pufferd.ServerStats{
-		Cpu:    cpu,
-		Memory: cast.ToFloat64(memMap.RSS),
-	}, nil
+	return s.sampler.Sample(pid, uint64(s.Limits.Memory)*1024*1024)
 }
 
 func (s *standard) Create() error {
@@ -164,35 +199,48 @@ func (s *standard) WaitForMainProcessFor(timeout int) (err error) {
 }
 
 func (s *standard) SendCode(code int) error {
-	running, err := s.IsRunning()
+	s.processLock.Lock()
+	defer s.processLock.Unlock()
 
-	if err != nil || !running {
-		return err
+	if !s.isRunning() {
+		return nil
 	}
-
 	return s.mainProcess.Process.Signal(syscall.Signal(code))
 }
 
-func (s *standard) handleClose(callback func(graceful bool)) {
-	err := s.mainProcess.Wait()
-	s.Wait.Done()
+func (s *standard) handleClose(process *exec.Cmd, callback envs.ExitCallback) {
+	err := process.Wait()
 
-	var graceful bool
-	if s.mainProcess == nil || s.mainProcess.ProcessState == nil || err != nil {
-		graceful = false
-		callback(false)
-	} else {
-		graceful = s.mainProcess.ProcessState.Success()
+	status := envs.CreateExitStatus(process.ProcessState)
+	if err != nil {
+		if _, exited := err.(*exec.ExitError); !exited {
+			status.Graceful = false
+		}
 	}
 
-	if s.mainProcess != nil && s.mainProcess.Process != nil {
-		s.mainProcess.Process.Release()
+	if s.cgroup != nil {
+		if s.cgroup.OOMKilled() {
+			status.OOMKilled = true
+			status.Graceful = false
+		}
+		if err := s.cgroup.Close(); err != nil {
+			logging.Exception("error removing cgroup", err)
+		}
+		s.cgroup = nil
 	}
 
+	s.processLock.Lock()
+	if process.Process != nil {
+		_ = process.Process.Release()
+	}
 	s.mainProcess = nil
 	s.stdInWriter = nil
+	s.processLock.Unlock()
 
+	//Run the callback before releasing waiters, so they see the state it leaves behind
 	if callback != nil {
-		callback(graceful)
+		callback(status)
 	}
+
+	s.Wait.Done()
 }
@@ -27,8 +27,10 @@ type EnvironmentFactory struct {
 func (ef EnvironmentFactory) Create(id string) envs.Environment {
 	s := &standard{
 		BaseEnvironment: &envs.BaseEnvironment{Type: "standard"},
+		id:              id,
 	}
 	s.BaseEnvironment.ExecutionFunction = s.standardExecuteAsync
+	s.BaseEnvironment.WaitFunction = s.WaitForMainProcess
 	return s
 }
 
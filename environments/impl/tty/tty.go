@@ -23,24 +23,30 @@ import (
 	"github.com/creack/pty"
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/environments/cgroups"
 	"github.com/pufferpanel/pufferd/v2/environments/envs"
-	"github.com/shirou/gopsutil/process"
-	"github.com/spf13/cast"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type tty struct {
 	*envs.BaseEnvironment
+	Limits      envs.ResourceLimits `json:"limits,omitempty"`
+	id          string
 	mainProcess *exec.Cmd
 	stdInWriter io.Writer
+	//Guards mainProcess and stdInWriter, which are cleared by the goroutine waiting on the process
+	processLock sync.Mutex
+	cgroup      *cgroups.Group
+	sampler     envs.ProcessSampler
 }
 
-func (t *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string, callback func(graceful bool)) (err error) {
+func (t *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string, callback envs.ExitCallback) (err error) {
 	running, err := t.IsRunning()
 	if err != nil {
 		return
@@ -59,51 +65,90 @@ func (t *tty) ttyExecuteAsync(cmd string, args []string, env map[string]string,
 	}
 
 	wrapper := t.CreateWrapper()
-	t.Wait.Add(1)
 	pr.SysProcAttr = &syscall.SysProcAttr{Setctty: true, Setsid: true}
-	t.mainProcess = pr
-	logging.Debug("Starting process: %s %s", t.mainProcess.Path, strings.Join(t.mainProcess.Args[1:], " "))
+
+	if !t.Limits.IsEmpty() {
+		t.cgroup, err = cgroups.Create(t.id, t.Limits)
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error applying resource limits for server %s", t.id), err)
+			t.DisplayToConsole(true, "Failed to apply resource limits\n")
+			return
+		}
+	}
+
+	t.Wait.Add(1)
+	logging.Debug("Starting process: %s %s", pr.Path, strings.Join(pr.Args[1:], " "))
 	tty, err := pty.Start(pr)
 	if err != nil {
+		if t.cgroup != nil {
+			_ = t.cgroup.Close()
+			t.cgroup = nil
+		}
+		t.Wait.Done()
 		return
 	}
 
+	if t.cgroup != nil {
+		err = t.cgroup.Started(t, pr.Process.Pid)
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error applying resource limits for server %s", t.id), err)
+			t.DisplayToConsole(true, "Failed to apply resource limits\n")
+			_ = pr.Process.Kill()
+			_ = pr.Wait()
+			_ = tty.Close()
+			_ = t.cgroup.Close()
+			t.cgroup = nil
+			t.Wait.Done()
+			return
+		}
+	}
+
+	t.processLock.Lock()
+	t.mainProcess = pr
 	t.stdInWriter = tty
+	t.processLock.Unlock()
 
 	go func(proxy io.Writer) {
 		_, _ = io.Copy(proxy, tty)
 	}(wrapper)
 
-	go t.handleClose(callback)
+	go t.handleClose(pr, callback)
 	return
 }
 
 func (t *tty) ExecuteInMainProcess(cmd string) (err error) {
-	running, err := t.IsRunning()
-	if err != nil {
-		return err
-	}
+	t.processLock.Lock()
+	running := t.isRunning()
+	stdIn := t.stdInWriter
+	t.processLock.Unlock()
+
 	if !running {
 		err = pufferd.ErrServerOffline
 		return
 	}
-	stdIn := t.stdInWriter
 	_, err = io.WriteString(stdIn, cmd+"\n")
 	return
 }
 
 func (t *tty) Kill() (err error) {
-	running, err := t.IsRunning()
-	if err != nil {
-		return
-	}
-	if !running {
+	t.processLock.Lock()
+	defer t.processLock.Unlock()
+
+	if !t.isRunning() {
 		return
 	}
 	return t.mainProcess.Process.Kill()
 }
 
 func (t *tty) IsRunning() (isRunning bool, err error) {
+	t.processLock.Lock()
+	defer t.processLock.Unlock()
+
+	return t.isRunning(), nil
+}
+
+//Callers must hold processLock.
+func (t *tty) isRunning() (isRunning bool) {
 	isRunning = t.mainProcess != nil && t.mainProcess.Process != nil
 	if isRunning {
 		pr, pErr := os.FindProcess(t.mainProcess.Process.Pid)
@@ -117,25 +162,15 @@ func (t *tty) IsRunning() (isRunning bool, err error) {
 }
 
 func (t *tty) GetStats() (*pufferd.ServerStats, error) {
-	running, err := t.IsRunning()
-	if err != nil {
-		return nil, err
-	}
-	if !running {
+	t.processLock.Lock()
+	if !t.isRunning() {
+		t.processLock.Unlock()
 		return nil, pufferd.ErrServerOffline
 	}
-	pr, err := process.NewProcess(int32(t.mainProcess.Process.Pid))
-	if err != nil {
-		return nil, err
-	}
-
-	memMap, _ := pr.MemoryInfo()
-	cpu, _ := pr.Percent(time.Second * 1)
+	pid := t.mainProcess.Process.Pid
+	t.processLock.Unlock()
 
-	return &pufferd.ServerStats{
-		Cpu:    cpu,
-		Memory: cast.ToFloat64(memMap.RSS),
-	}, nil
+	return t.sampler.Sample(pid, uint64(t.Limits.Memory)*1024*1024)
 }
 
 func (t *tty) Create() error {
@@ -166,32 +201,55 @@ func (t *tty) WaitForMainProcessFor(timeout int) (err error) {
 }
 
 func (t *tty) SendCode(code int) error {
-	running, err := t.IsRunning()
+	t.processLock.Lock()
+	defer t.processLock.Unlock()
 
-	if err != nil || !running {
-		return err
+	if !t.isRunning() {
+		return nil
 	}
-
 	return t.mainProcess.Process.Signal(syscall.Signal(code))
 }
 
-func (t *tty) handleClose(callback func(graceful bool)) {
-	err := t.mainProcess.Wait()
+func (t *tty) Pause() error {
+	return t.SendCode(int(syscall.SIGSTOP))
+}
+
+func (t *tty) Resume() error {
+	return t.SendCode(int(syscall.SIGCONT))
+}
+
+func (t *tty) handleClose(process *exec.Cmd, callback envs.ExitCallback) {
+	err := process.Wait()
+
+	status := envs.CreateExitStatus(process.ProcessState)
+	if err != nil {
+		if _, exited := err.(*exec.ExitError); !exited {
+			status.Graceful = false
+		}
+	}
 
-	var success bool
-	if t.mainProcess == nil || t.mainProcess.ProcessState == nil || err != nil {
-		success = false
-	} else {
-		success = t.mainProcess.ProcessState.Success()
+	if t.cgroup != nil {
+		if t.cgroup.OOMKilled() {
+			status.OOMKilled = true
+			status.Graceful = false
+		}
+		if err := t.cgroup.Close(); err != nil {
+			logging.Exception("error removing cgroup", err)
+		}
+		t.cgroup = nil
 	}
 
-	if t.mainProcess != nil && t.mainProcess.Process != nil {
-		_ = t.mainProcess.Process.Release()
+	t.processLock.Lock()
+	if process.Process != nil {
+		_ = process.Process.Release()
 	}
 	t.mainProcess = nil
-	t.Wait.Done()
+	t.stdInWriter = nil
+	t.processLock.Unlock()
 
 	if callback != nil {
-		callback(success)
+		callback(status)
 	}
+
+	t.Wait.Done()
 }
@@ -29,8 +29,10 @@ type EnvironmentFactory struct {
 func (ef EnvironmentFactory) Create(id string) envs.Environment {
 	t := &tty{
 		BaseEnvironment: &envs.BaseEnvironment{Type: "tty"},
+		id:              id,
 	}
 	t.BaseEnvironment.ExecutionFunction = t.ttyExecuteAsync
+	t.BaseEnvironment.WaitFunction = t.WaitForMainProcess
 	return t
 }
 
@@ -36,7 +36,40 @@ var ErrMissingAccessToken = apufferi.CreateError("access token not provided", "E
 var ErrNotBearerToken = apufferi.CreateError("access token must be a Bearer token", "ErrNotBearerToken")
 var ErrKeyNotECDSA = apufferi.CreateError("key is not ECDSA key", "ErrKeyNotECDSA")
 var ErrMissingScope = apufferi.CreateError("missing scope", "ErrMissingScope")
+var ErrInvalidSchedule = apufferi.CreateError("schedule has an invalid cron expression, unknown action or missing fields", "ErrInvalidSchedule")
+var ErrScheduleNotFound = apufferi.CreateError("schedule not found", "ErrScheduleNotFound")
+var ErrNotSupported = apufferi.CreateError("operation not supported by this environment", "ErrNotSupported")
+var ErrBackupInProgress = apufferi.CreateError("backup already in progress", "ErrBackupInProgress")
+var ErrBackupNotFound = apufferi.CreateError("backup not found", "ErrBackupNotFound")
+var ErrUnknownBackupFormat = apufferi.CreateError("unknown backup format", "ErrUnknownBackupFormat")
+var ErrRestartPolicyNotSupported = apufferi.CreateError("docker restart policies are not supported, use the server's auto restart settings instead", "ErrRestartPolicyNotSupported")
+var ErrStopTimeout = apufferi.CreateError("server did not stop in time", "ErrStopTimeout")
+var ErrStatsTimeout = apufferi.CreateError("container stats were not received in time", "ErrStatsTimeout")
+var ErrInvalidState = apufferi.CreateError("cannot ${action} while server is ${state}", "ErrInvalidState")
+var ErrInvalidStep = apufferi.CreateError("step must be a positive number of seconds", "ErrInvalidStep")
+var ErrLogNotFound = apufferi.CreateError("log file not found", "ErrLogNotFound")
+var ErrInvalidCursor = apufferi.CreateError("cursor is not valid", "ErrInvalidCursor")
+var ErrInvalidPattern = apufferi.CreateError("pattern is not a valid regular expression", "ErrInvalidPattern")
+var ErrSourceNotRecorded = apufferi.CreateError("console log files do not record who wrote each line, search memory to filter by source", "ErrSourceNotRecorded")
+var ErrInvalidConsoleRule = apufferi.CreateError("console rule has an invalid pattern, unknown action or missing fields", "ErrInvalidConsoleRule")
+var ErrInvalidHealthCheck = apufferi.CreateError("health check has an unknown type or missing fields", "ErrInvalidHealthCheck")
+var ErrSocketClosed = apufferi.CreateError("websocket is closed", "ErrSocketClosed")
+var ErrInvalidMessage = apufferi.CreateError("message is not valid", "ErrInvalidMessage")
+var ErrUnknownMessage = apufferi.CreateError("unknown message type ${type}", "ErrUnknownMessage")
+var ErrUnsupportedVersion = apufferi.CreateError("protocol version ${version} is not supported", "ErrUnsupportedVersion")
 
 func CreateErrMissingScope(scope scope.Scope) *apufferi.Error {
 	return apufferi.CreateError(ErrMissingScope.Message, ErrMissingScope.Code).Metadata(map[string]interface{}{"scope": scope})
 }
+
+func CreateErrUnknownMessage(messageType string) *apufferi.Error {
+	return apufferi.CreateError(ErrUnknownMessage.Message, ErrUnknownMessage.Code).Metadata(map[string]interface{}{"type": messageType})
+}
+
+func CreateErrUnsupportedVersion(version, supported int) *apufferi.Error {
+	return apufferi.CreateError(ErrUnsupportedVersion.Message, ErrUnsupportedVersion.Code).Metadata(map[string]interface{}{"version": version, "supported": supported})
+}
+
+func CreateErrInvalidState(state, action string) *apufferi.Error {
+	return apufferi.CreateError(ErrInvalidState.Message, ErrInvalidState.Code).Metadata(map[string]interface{}{"state": state, "action": action})
+}
@@ -92,6 +92,7 @@ func OAuth2Handler(requiredScope scope.Scope, requireServer bool) gin.HandlerFun
 		}
 
 		c.Set("scopes", scopes)
+		c.Set("subject", token.Claims.Subject)
 
 		failure = false
 	}
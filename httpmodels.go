@@ -7,8 +7,28 @@ type ServerIdResponse struct {
 }
 
 type ServerStats struct {
-	Cpu    float64 `json:"cpu"`
-	Memory float64 `json:"memory"`
+	//CPU usage as a percentage of a single core, so 200 means two full cores, measured over the last few seconds at most
+	Cpu float64 `json:"cpu"`
+	//Memory in use, in bytes
+	Memory uint64 `json:"memory"`
+	//Memory the server is allowed to use, in bytes
+	MemoryLimit uint64 `json:"memoryLimit"`
+	//Bytes received and sent over the network
+	NetworkRx uint64 `json:"networkRx"`
+	NetworkTx uint64 `json:"networkTx"`
+	//Bytes read from and written to disk
+	BlockRead  uint64 `json:"blockRead"`
+	BlockWrite uint64 `json:"blockWrite"`
+	//Number of processes, including the main process
+	Pids uint64 `json:"pids"`
+	//Seconds since the main process started
+	Uptime int64 `json:"uptime"`
+}
+
+type ServerStatsSample struct {
+	//UNIX time the sample was taken, or the start of the period it covers when downsampled
+	Time int64 `json:"time"`
+	ServerStats
 }
 
 type ServerLogs struct {
@@ -16,8 +36,168 @@ type ServerLogs struct {
 	Logs  string `json:"logs"`
 }
 
+const (
+	ConsoleSourceProcess = "process"
+	ConsoleSourceDaemon  = "daemon"
+
+	ConsoleStreamStdout = "stdout"
+	ConsoleStreamStderr = "stderr"
+)
+
+type ConsoleLine struct {
+	//Increases by one for each finished line, so clients can tell which lines they have already seen.
+	//Unfinished lines have no sequence, and are replaced by the next line from the same source and stream
+	Sequence uint64 `json:"sequence,omitempty"`
+	//UNIX time the line was written
+	Time int64 `json:"time"`
+	//Either process, daemon or the name of the operation that wrote the line
+	Source  string `json:"source"`
+	Stream  string `json:"stream"`
+	Line    string `json:"line"`
+	Partial bool   `json:"partial,omitempty"`
+}
+
+type ServerConsoleLine struct {
+	//Refers to this line when paging with before or after
+	Cursor string `json:"cursor"`
+	//UNIX time the line was written, if known
+	Time int64 `json:"time,omitempty"`
+	//Only known for lines held in memory, as the log files do not record who wrote each line
+	Daemon bool   `json:"daemon,omitempty"`
+	Source string `json:"source,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Line   string `json:"line"`
+}
+
+type ServerConsoleHistory struct {
+	Lines []ServerConsoleLine `json:"lines"`
+	//Whether more matching lines exist past these, in the direction being paged
+	More bool `json:"more"`
+}
+
+type ServerEvent struct {
+	Server string `json:"server"`
+	Event  string `json:"event"`
+	//UNIX time the event happened
+	Time int64             `json:"time"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
 type ServerRunning struct {
-	Running bool `json:"running"`
+	Running  bool        `json:"running"`
+	State    string      `json:"state"`
+	LastExit *ExitStatus `json:"lastExit,omitempty"`
+	//Whether every health check is passing, if the server has any and is running
+	Healthy *bool                   `json:"healthy,omitempty"`
+	Health  map[string]HealthResult `json:"health,omitempty"`
+}
+
+type HealthResult struct {
+	Healthy bool `json:"healthy"`
+	//Failures in a row, reset when a check passes
+	Failures int `json:"failures"`
+	//UNIX time of the last check
+	Checked int64  `json:"checked"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ServerBackup struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+}
+
+type ServerLogFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Modified int64  `json:"modified"`
+}
+
+const (
+	CommandTransportHttp      = "http"
+	CommandTransportWebsocket = "websocket"
+	CommandTransportSchedule  = "schedule"
+	CommandTransportRule      = "rule"
+	CommandTransportHealth    = "health"
+	CommandTransportSftp      = "sftp"
+	//Commands the daemon sends itself, such as the stop command and the save command before a backup
+	CommandTransportDaemon = "daemon"
+)
+
+//Who sent a command to a server, and how.
+type CommandSource struct {
+	//Subject of the token the command was sent with, empty for commands the daemon sent itself
+	Subject   string `json:"subject,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Transport string `json:"transport"`
+}
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultDenied  = "denied"
+	AuditResultFailure = "failure"
+)
+
+//Actions recorded in the audit log. Actions on a running server are named after the websocket request for them,
+//so the same action is recorded under the same name however it was taken
+const (
+	AuditActionServerCreate = "server.create"
+	AuditActionServerDelete = "server.delete"
+	AuditActionServerEdit   = "server.edit"
+
+	AuditActionStart   = "start"
+	AuditActionStop    = "stop"
+	AuditActionRestart = "restart"
+	AuditActionKill    = "kill"
+	AuditActionInstall = "install"
+	AuditActionReload  = "reload"
+	AuditActionUpdate  = "update"
+	AuditActionConsole = "console"
+
+	AuditActionFileWrite  = "file.write"
+	AuditActionFileDelete = "file.delete"
+	AuditActionFileCreate = "file.create"
+	AuditActionFileRename = "file.rename"
+
+	AuditActionScheduleEdit   = "schedule.edit"
+	AuditActionScheduleDelete = "schedule.delete"
+
+	AuditActionBackupCreate  = "backup.create"
+	AuditActionBackupDelete  = "backup.delete"
+	AuditActionBackupRestore = "backup.restore"
+)
+
+//An action taken against the daemon or a server, as recorded in the audit log.
+type AuditEntry struct {
+	Time int64 `json:"time"`
+	//Token subject or SFTP user that took the action, empty if it could not be identified
+	Actor     string `json:"actor,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Transport string `json:"transport"`
+	Action    string `json:"action"`
+	Server    string `json:"server,omitempty"`
+	Path      string `json:"path,omitempty"`
+	//Where a file was renamed to
+	Target string `json:"target,omitempty"`
+	//Command sent to the server's console
+	Command string `json:"command,omitempty"`
+	Result  string `json:"result"`
+	//Status of the HTTP response
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ServerCrash struct {
+	ExitStatus
+	Time    int64    `json:"time"`
+	Console []string `json:"console"`
+}
+
+type ExitStatus struct {
+	Graceful  bool   `json:"graceful"`
+	ExitCode  int    `json:"exitCode"`
+	Signal    string `json:"signal,omitempty"`
+	OOMKilled bool   `json:"oomKilled,omitempty"`
 }
 
 type ServerData struct {
@@ -18,6 +18,8 @@ package messages
 
 import (
 	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/pufferd/v2"
 )
 
 type Message interface {
@@ -27,6 +29,8 @@ type Message interface {
 type Transmission struct {
 	Message Message `json:"data"`
 	Type    string  `json:"type"`
+	//Id of the request this replies to
+	Id string `json:"id,omitempty"`
 }
 
 func Write(c *websocket.Conn, msg Message) error {
@@ -34,20 +38,49 @@ func Write(c *websocket.Conn, msg Message) error {
 }
 
 type StatMessage struct {
-	Memory float64 `json:"memory"`
-	Cpu    float64 `json:"cpu"`
+	pufferd.ServerStats
 }
 
 type ConsoleMessage struct {
 	Logs []string `json:"logs"`
 }
 
+//Console output for sockets that asked for structured lines.
+type ConsoleLinesMessage struct {
+	Lines []pufferd.ConsoleLine `json:"lines"`
+}
+
+type EventMessage struct {
+	pufferd.ServerEvent
+}
+
+type StatusMessage struct {
+	Running bool   `json:"running"`
+	State   string `json:"state"`
+}
+
 type PingMessage struct {
 }
 
 type PongMessage struct {
 }
 
+//Sent when a socket opens, so clients know which protocol version to speak.
+type VersionMessage struct {
+	Version int `json:"version"`
+}
+
+//Acknowledges a request that has nothing else to reply with.
+type ResultMessage struct {
+	Action string `json:"action"`
+}
+
+//Replies to a request that could not be handled.
+type ErrorMessage struct {
+	Action string          `json:"action,omitempty"`
+	Error  *apufferi.Error `json:"error"`
+}
+
 type FileListMessage struct {
 	CurrentPath string     `json:"path"`
 	Error       string     `json:"error,omitempty"`
@@ -65,6 +98,18 @@ func (m ConsoleMessage) Key() string {
 	return "console"
 }
 
+func (m ConsoleLinesMessage) Key() string {
+	return "console"
+}
+
+func (m EventMessage) Key() string {
+	return "event"
+}
+
+func (m StatusMessage) Key() string {
+	return "status"
+}
+
 func (m PingMessage) Key() string {
 	return "ping"
 }
@@ -76,3 +121,15 @@ func (m PongMessage) Key() string {
 func (m FileListMessage) Key() string {
 	return "file"
 }
+
+func (m VersionMessage) Key() string {
+	return "version"
+}
+
+func (m ResultMessage) Key() string {
+	return "result"
+}
+
+func (m ErrorMessage) Key() string {
+	return "error"
+}
@@ -0,0 +1,41 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package messages
+
+//Version of the websocket protocol this daemon speaks.
+//Requests without a version are read as this version, requests with a newer version are refused.
+const Version = 1
+
+//A message sent by a websocket client. Only the fields used by the type are read.
+type Request struct {
+	Version int `json:"version,omitempty"`
+	//Echoed in the reply, so clients can match replies to requests
+	Id   string `json:"id,omitempty"`
+	Type string `json:"type"`
+
+	//stat
+	Subscribe *bool `json:"subscribe,omitempty"`
+	Interval  int   `json:"interval,omitempty"`
+
+	//console
+	Command string `json:"command,omitempty"`
+
+	//file
+	Action string `json:"action,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Edit   bool   `json:"edit,omitempty"`
+}
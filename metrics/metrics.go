@@ -0,0 +1,117 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const namespace = "pufferd"
+
+var httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "http_requests_total",
+	Help:      "HTTP requests handled, by method, handler and status code.",
+}, []string{"method", "handler", "code"})
+
+var httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "Time taken to handle HTTP requests, by method and handler.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method", "handler"})
+
+var operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "operation_duration_seconds",
+	Help:      "Time taken to run install, pre and post execution operations, by operation type.",
+	Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+}, []string{"operation"})
+
+var WebSockets = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "websocket_connections",
+	Help:      "Open websocket connections.",
+})
+
+var SFTPSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "sftp_sessions",
+	Help:      "Open SFTP sessions.",
+})
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, operationDuration, WebSockets, SFTPSessions)
+}
+
+func Register(collector prometheus.Collector) {
+	prometheus.MustRegister(collector)
+}
+
+//Records how long an operation of the given type took to run.
+func ObserveOperation(operation string, duration time.Duration) {
+	operationDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+//Counts and times each request.
+//Websocket upgrades are counted but not timed, since they last as long as the socket is open.
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	handler := c.HandlerName()
+	if i := strings.LastIndex(handler, "/"); i != -1 {
+		handler = handler[i+1:]
+	}
+
+	httpRequests.WithLabelValues(c.Request.Method, handler, strconv.Itoa(c.Writer.Status())).Inc()
+	if c.GetHeader("Connection") != "Upgrade" {
+		httpDuration.WithLabelValues(c.Request.Method, handler).Observe(time.Since(start).Seconds())
+	}
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+//Serves the metrics without authorization on listen.metrics, if it has been set.
+//This is meant for a private address a Prometheus server can scrape.
+func Run() {
+	bind := viper.GetString("listen.metrics")
+	if bind == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		logging.Info("Starting metrics on %s", bind)
+		err := http.ListenAndServe(bind, mux)
+		if err != nil {
+			logging.Exception("Error starting metrics server", err)
+		}
+	}()
+}
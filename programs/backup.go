@@ -0,0 +1,680 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BackupFormatTarGz = "tar.gz"
+	BackupFormatZip   = "zip"
+
+	BackupModeNone  = ""
+	BackupModeSave  = "save"
+	BackupModeStop  = "stop"
+	BackupModePause = "pause"
+)
+
+type BackupSettings struct {
+	Format      string `json:"format,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	SaveCommand string `json:"saveCommand,omitempty"`
+	SaveDelay   int    `json:"saveDelay,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+}
+
+var backupsRunning = make(map[string]bool)
+var backupLock = sync.Mutex{}
+
+func (p *Program) getBackupFolder() string {
+	return apufferi.JoinPath(viper.GetString("data.backups"), p.Id())
+}
+
+func (p *Program) getBackupFile(name string) (string, error) {
+	folder := p.getBackupFolder()
+	if name == "" || filepath.Base(name) != name {
+		return "", pufferd.ErrIllegalFileAccess
+	}
+	file := apufferi.JoinPath(folder, name)
+	if !apufferi.EnsureAccess(file, folder) {
+		return "", pufferd.ErrIllegalFileAccess
+	}
+	return file, nil
+}
+
+//Marks this program as having a backup or restore running.
+//Returns false if one is already running.
+func (p *Program) lockBackup() bool {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	if backupsRunning[p.Id()] {
+		return false
+	}
+	backupsRunning[p.Id()] = true
+	return true
+}
+
+func (p *Program) unlockBackup() {
+	backupLock.Lock()
+	defer backupLock.Unlock()
+
+	delete(backupsRunning, p.Id())
+}
+
+//Creates a backup of the server's files, following the server's backup settings.
+//Older backups past the retention limit are removed afterwards.
+func (p *Program) CreateBackup() (backup *pufferd.ServerBackup, err error) {
+	if !p.lockBackup() {
+		return nil, pufferd.ErrBackupInProgress
+	}
+	defer p.unlockBackup()
+
+	settings := p.Backup
+	format := settings.Format
+	if format == "" {
+		format = BackupFormatTarGz
+	}
+	if format != BackupFormatTarGz && format != BackupFormatZip {
+		return nil, pufferd.ErrUnknownBackupFormat
+	}
+
+	logging.Debug("Backing up server %s", p.Id())
+	p.Environment.DisplayToConsole(true, "Backing up server\n")
+
+	running, err := p.IsRunning()
+	if err != nil {
+		return
+	}
+
+	if running {
+		switch settings.Mode {
+		case BackupModeSave:
+			if settings.SaveCommand != "" {
+				p.Environment.DisplayToConsole(true, "Saving server before backup\n")
+				err = p.ExecuteFrom(settings.SaveCommand, pufferd.CommandSource{Transport: pufferd.CommandTransportDaemon})
+				if err != nil {
+					break
+				}
+				delay := settings.SaveDelay
+				if delay <= 0 {
+					delay = 5
+				}
+				time.Sleep(time.Duration(delay) * time.Second)
+			}
+		case BackupModeStop:
+			p.Environment.DisplayToConsole(true, "Stopping server for backup\n")
+			err = p.StopAndWait()
+			if err == nil {
+				defer func() {
+					p.Environment.DisplayToConsole(true, "Starting server after backup\n")
+					if startErr := p.Start(); startErr != nil {
+						logging.Exception("error starting server "+p.Id()+" after backup", startErr)
+					}
+				}()
+			}
+		case BackupModePause:
+			p.Environment.DisplayToConsole(true, "Pausing server for backup\n")
+			err = p.Environment.Pause()
+			if err == nil {
+				defer func() {
+					p.Environment.DisplayToConsole(true, "Resuming server after backup\n")
+					if resumeErr := p.Environment.Resume(); resumeErr != nil {
+						logging.Exception("error resuming server "+p.Id()+" after backup", resumeErr)
+					}
+				}()
+			}
+		}
+	}
+
+	if err != nil {
+		logging.Exception("Error preparing server for backup", err)
+		p.Environment.DisplayToConsole(true, "Failed to back up server\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		return
+	}
+
+	folder := p.getBackupFolder()
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return
+	}
+
+	file, name, err := createBackupFile(folder, format)
+	if err != nil {
+		return
+	}
+	target := file.Name()
+
+	switch format {
+	case BackupFormatZip:
+		err = writeZip(p.Environment, file)
+	default:
+		err = writeTarGz(p.Environment, file)
+	}
+
+	if err != nil {
+		_ = os.Remove(target)
+		logging.Exception("Error backing up server", err)
+		p.Environment.DisplayToConsole(true, "Failed to back up server\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return
+	}
+
+	p.Environment.DisplayToConsole(true, "Backup %s created\n", name)
+	p.pruneBackups()
+	p.emitEvent("backupCreated", map[string]string{"name": name, "size": strconv.FormatInt(info.Size(), 10)})
+
+	return &pufferd.ServerBackup{Name: name, Size: info.Size(), Created: info.ModTime().Unix()}, nil
+}
+
+//Lists the backups for this server, newest first.
+func (p *Program) GetBackups() ([]pufferd.ServerBackup, error) {
+	files, err := ioutil.ReadDir(p.getBackupFolder())
+	if err != nil && os.IsNotExist(err) {
+		return make([]pufferd.ServerBackup, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && isBackupFile(file.Name()) {
+			backups = append(backups, file)
+		}
+	}
+
+	//sort on the full modification time, as several backups can be made within a second
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ModTime().After(backups[j].ModTime())
+	})
+
+	result := make([]pufferd.ServerBackup, len(backups))
+	for i, file := range backups {
+		result[i] = pufferd.ServerBackup{Name: file.Name(), Size: file.Size(), Created: file.ModTime().Unix()}
+	}
+	return result, nil
+}
+
+func (p *Program) OpenBackup(name string) (*FileData, error) {
+	file, err := p.getBackupFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil && os.IsNotExist(err) {
+		return nil, pufferd.ErrBackupNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return &FileData{Contents: f, ContentLength: info.Size(), Name: info.Name()}, nil
+}
+
+func (p *Program) DeleteBackup(name string) error {
+	file, err := p.getBackupFile(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(file)
+	if err != nil && os.IsNotExist(err) {
+		return pufferd.ErrBackupNotFound
+	}
+	return err
+}
+
+//Replaces the server's files with the contents of the given backup.
+//The server is stopped first if it is running. The backup is extracted next to the server's files,
+//which are only replaced once it has been extracted successfully.
+func (p *Program) RestoreBackup(name string) (err error) {
+	file, err := p.getBackupFile(name)
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(file); err != nil && os.IsNotExist(err) {
+		return pufferd.ErrBackupNotFound
+	} else if err != nil {
+		return
+	}
+
+	if !p.lockBackup() {
+		return pufferd.ErrBackupInProgress
+	}
+	defer p.unlockBackup()
+
+	running, err := p.IsRunning()
+	if err != nil {
+		return
+	}
+
+	if running {
+		p.Environment.DisplayToConsole(true, "Stopping server for restore\n")
+		err = p.StopAndWait()
+		if err != nil {
+			return
+		}
+	}
+
+	//keeps the server from being started or installed against a partly restored directory
+	err = p.transition("restore", StateRestoring, StateStopped, StateCrashed)
+	if err != nil {
+		return
+	}
+	defer p.setState(StateStopped)
+
+	logging.Debug("Restoring backup %s for server %s", name, p.Id())
+	p.Environment.DisplayToConsole(true, "Restoring backup %s\n", name)
+
+	root := p.Environment.GetRootDirectory()
+	temp := root + ".restore"
+	err = os.RemoveAll(temp)
+	if err == nil {
+		err = os.MkdirAll(temp, 0755)
+	}
+	if err == nil {
+		if strings.HasSuffix(name, "."+BackupFormatZip) {
+			err = extractZip(file, temp)
+		} else {
+			err = extractTarGz(file, temp)
+		}
+	}
+	if err == nil {
+		err = replaceContents(root, temp)
+	}
+
+	if removeErr := os.RemoveAll(temp); removeErr != nil {
+		logging.Exception("error removing restore folder "+temp, removeErr)
+	}
+
+	if err != nil {
+		logging.Exception("Error restoring backup", err)
+		p.Environment.DisplayToConsole(true, "Failed to restore backup\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		return
+	}
+
+	p.Environment.DisplayToConsole(true, "Backup %s restored\n", name)
+	return
+}
+
+//Replaces everything in root with the contents of source, which must be on the same filesystem.
+//Root itself is kept, as it may be mounted into the server's environment.
+//The old contents are moved aside first, and are put back if the new contents cannot be moved in.
+func replaceContents(root, source string) error {
+	old := root + ".old"
+	err := os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(old, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = moveContents(root, old)
+	if err == nil {
+		err = moveContents(source, root)
+	}
+	if err != nil {
+		//only new files can be in root now, so clear them out and put back the old ones
+		restoreErr := removeContents(root)
+		if restoreErr == nil {
+			restoreErr = moveContents(old, root)
+		}
+		if restoreErr != nil {
+			logging.Exception("error putting back files in "+root+", they are in "+old, restoreErr)
+			return err
+		}
+	}
+
+	if removeErr := os.RemoveAll(old); removeErr != nil {
+		logging.Exception("error removing old files in "+old, removeErr)
+	}
+	return err
+}
+
+func removeContents(folder string) error {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err = os.RemoveAll(filepath.Join(folder, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Moves every entry in the source folder into the target folder, replacing any entry with the same name.
+func moveContents(source, target string) error {
+	files, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		destination := filepath.Join(target, f.Name())
+		err = os.RemoveAll(destination)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(source, f.Name()), destination)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Program) pruneBackups() {
+	limit := p.Backup.Limit
+	if limit <= 0 {
+		limit = viper.GetInt("data.backupLimit")
+	}
+	if limit <= 0 {
+		return
+	}
+
+	backups, err := p.GetBackups()
+	if err != nil {
+		logging.Exception("error listing backups for "+p.Id(), err)
+		return
+	}
+
+	for i := limit; i < len(backups); i++ {
+		logging.Debug("Removing old backup %s for server %s", backups[i].Name, p.Id())
+		if err = p.DeleteBackup(backups[i].Name); err != nil {
+			logging.Exception("error removing old backup "+backups[i].Name, err)
+		}
+	}
+}
+
+//Creates the file for a new backup, named after the current time.
+//Backups made within the same second are told apart by a counter after the time.
+func createBackupFile(folder, format string) (*os.File, string, error) {
+	stamp := time.Now().Format("20060102-150405")
+	name := stamp + "." + format
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(apufferi.JoinPath(folder, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			return file, name, nil
+		} else if !os.IsExist(err) {
+			return nil, "", err
+		}
+		name = stamp + "-" + strconv.Itoa(i) + "." + format
+	}
+}
+
+func isBackupFile(name string) bool {
+	return strings.HasSuffix(name, "."+BackupFormatTarGz) || strings.HasSuffix(name, "."+BackupFormatZip)
+}
+
+//Reports archiving progress to the console every 10 percent.
+type backupProgress struct {
+	env      envs.Environment
+	total    int64
+	written  int64
+	reported int64
+}
+
+func createBackupProgress(env envs.Environment, root string) *backupProgress {
+	progress := &backupProgress{env: env}
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			progress.total += info.Size()
+		}
+		return nil
+	})
+	return progress
+}
+
+func (b *backupProgress) Write(p []byte) (n int, err error) {
+	b.written += int64(len(p))
+	if b.total > 0 {
+		percent := b.written * 100 / b.total
+		if percent/10 > b.reported/10 {
+			b.reported = percent
+			b.env.DisplayToConsole(true, "Backup progress: %d%%\n", percent)
+		}
+	}
+	return len(p), nil
+}
+
+//Walks the root of the environment, calling the function with the path relative to root
+//for every directory and regular file. Symlinks and special files are skipped.
+func walkRoot(root string, fn func(path, relative string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || (!info.IsDir() && !info.Mode().IsRegular()) {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(relative), info)
+	})
+}
+
+func writeTarGz(env envs.Environment, file *os.File) error {
+	defer file.Close()
+	root := env.GetRootDirectory()
+	progress := createBackupProgress(env, root)
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	err := walkRoot(root, func(path, relative string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = relative
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return copyFileTo(path, io.MultiWriter(tw, progress))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeZip(env envs.Environment, file *os.File) error {
+	defer file.Close()
+	root := env.GetRootDirectory()
+	progress := createBackupProgress(env, root)
+
+	zw := zip.NewWriter(file)
+
+	err := walkRoot(root, func(path, relative string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = relative
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return copyFileTo(path, io.MultiWriter(writer, progress))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func copyFileTo(path string, writer io.Writer) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	_, err = io.Copy(writer, source)
+	return err
+}
+
+func extractTarGz(source, root string) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = extractEntry(root, header.Name, os.FileMode(header.Mode), true, nil)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractEntry(root, header.Name, os.FileMode(header.Mode), false, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(source, root string) error {
+	reader, err := zip.OpenReader(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		info := f.FileInfo()
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+
+		if info.IsDir() {
+			err = extractEntry(root, f.Name, info.Mode(), true, nil)
+		} else {
+			var contents io.ReadCloser
+			contents, err = f.Open()
+			if err != nil {
+				return err
+			}
+			err = extractEntry(root, f.Name, info.Mode(), false, contents)
+			_ = contents.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractEntry(root, name string, mode os.FileMode, dir bool, contents io.Reader) error {
+	root = apufferi.JoinPath(root)
+	target := apufferi.JoinPath(root, name)
+	if !apufferi.EnsureAccess(target, root) {
+		return pufferd.ErrIllegalFileAccess
+	}
+
+	if dir {
+		return os.MkdirAll(target, 0755)
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, contents)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,46 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"testing"
+)
+
+func TestCreateBackup_SameSecondGetsUniqueNames(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"sleep","arguments":["30"]}}`)
+	defer cleanup()
+
+	first, err := p.CreateBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.CreateBackup()
+	if err != nil {
+		t.Fatalf("expected a second backup in the same second to be created: %s", err)
+	}
+	if first.Name == second.Name {
+		t.Fatalf("expected unique backup names, both were %s", first.Name)
+	}
+
+	backups, err := p.GetBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Name != second.Name {
+		t.Fatalf("expected both backups, newest first, got %v", backups)
+	}
+}
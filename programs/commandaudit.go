@@ -0,0 +1,43 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/audit"
+)
+
+//Sends a command to the main process, recording it with who sent it in the audit log.
+func (p *Program) ExecuteFrom(command string, source pufferd.CommandSource) error {
+	err := p.Execute(command)
+
+	entry := pufferd.AuditEntry{
+		Actor:     source.Subject,
+		Address:   source.Address,
+		Transport: source.Transport,
+		Action:    pufferd.AuditActionConsole,
+		Server:    p.Id(),
+		Command:   command,
+		Result:    pufferd.AuditResultSuccess,
+	}
+	if err != nil {
+		entry.Result = pufferd.AuditResultFailure
+		entry.Error = err.Error()
+	}
+	audit.Record(entry)
+	return err
+}
@@ -0,0 +1,101 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func (p *Program) getConsoleLogFolder() string {
+	return apufferi.JoinPath(viper.GetString("data.logs"), p.Id())
+}
+
+func (p *Program) getConsoleLogFile(name string) (string, error) {
+	folder := p.getConsoleLogFolder()
+	if name == "" || filepath.Base(name) != name || !envs.IsConsoleLogFile(name) {
+		return "", pufferd.ErrIllegalFileAccess
+	}
+	file := apufferi.JoinPath(folder, name)
+	if !apufferi.EnsureAccess(file, folder) {
+		return "", pufferd.ErrIllegalFileAccess
+	}
+	return file, nil
+}
+
+//Lists the console log files for this server, newest first.
+//Only the current segment is left uncompressed.
+func (p *Program) GetConsoleLogs() ([]pufferd.ServerLogFile, error) {
+	files, err := ioutil.ReadDir(p.getConsoleLogFolder())
+	if err != nil && os.IsNotExist(err) {
+		return make([]pufferd.ServerLogFile, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := make([]pufferd.ServerLogFile, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || !envs.IsConsoleLogFile(file.Name()) {
+			continue
+		}
+		result = append(result, pufferd.ServerLogFile{Name: file.Name(), Size: file.Size(), Modified: file.ModTime().Unix()})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name > result[j].Name
+	})
+	return result, nil
+}
+
+func (p *Program) OpenConsoleLog(name string) (*FileData, error) {
+	file, err := p.getConsoleLogFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil && os.IsNotExist(err) {
+		return nil, pufferd.ErrLogNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	//the current log may still be growing, so only send what was there when it was opened
+	contents := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, info.Size()), f}
+	return &FileData{Contents: contents, ContentLength: info.Size(), Name: info.Name()}, nil
+}
+
+func (p *Program) deleteConsoleLogs() error {
+	if log := p.Environment.GetBase().ConsoleLog; log != nil {
+		_ = log.Close()
+	}
+	return os.RemoveAll(p.getConsoleLogFolder())
+}
@@ -0,0 +1,291 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/cache"
+	"github.com/pufferpanel/pufferd/v2/environments/envs"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Describes which console lines to return.
+//Without a cursor, the newest matching lines are returned.
+//With before, the newest matching lines older than it are returned, and with after, the oldest newer than it.
+type ConsoleQuery struct {
+	Limit    int
+	Before   string
+	After    string
+	Contains string
+	Pattern  *regexp.Regexp
+	//Only match lines written by the daemon or the process, or both if empty.
+	//Only lines held in memory record who wrote them, so this cannot be used with Files
+	Source string
+	//Search the console log files, rather than the lines held in memory
+	Files bool
+}
+
+func (q ConsoleQuery) matches(line string) bool {
+	if q.Contains != "" && !strings.Contains(line, q.Contains) {
+		return false
+	}
+	return q.Pattern == nil || q.Pattern.MatchString(line)
+}
+
+//Whether a line held in memory was written by the source the query is for.
+func (q ConsoleQuery) matchesSource(line pufferd.ConsoleLine) bool {
+	daemon := line.Source == pufferd.ConsoleSourceDaemon
+	return !(q.Source == pufferd.ConsoleSourceDaemon && !daemon || q.Source == pufferd.ConsoleSourceProcess && daemon)
+}
+
+//Searches this server's console history.
+func (p *Program) QueryConsole(query ConsoleQuery) (*pufferd.ServerConsoleHistory, error) {
+	if query.Before != "" && query.After != "" {
+		return nil, pufferd.ErrInvalidCursor
+	}
+	if query.Files && query.Source != "" {
+		return nil, pufferd.ErrSourceNotRecorded
+	}
+
+	var lines []pufferd.ServerConsoleLine
+	var more bool
+	var err error
+	if query.Files {
+		lines, more, err = p.queryConsoleFiles(query)
+	} else {
+		lines, more, err = p.queryConsoleMemory(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pufferd.ServerConsoleHistory{Lines: lines, More: more}, nil
+}
+
+//Memory cursors are the sequence number of the line.
+func (p *Program) queryConsoleMemory(query ConsoleQuery) ([]pufferd.ServerConsoleLine, bool, error) {
+	var before, after uint64
+	var err error
+	if query.Before != "" {
+		before, err = strconv.ParseUint(query.Before, 10, 64)
+	} else if query.After != "" {
+		after, err = strconv.ParseUint(query.After, 10, 64)
+	}
+	if err != nil {
+		return nil, false, pufferd.ErrInvalidCursor
+	}
+
+	matches := make([]pufferd.ServerConsoleLine, 0)
+	for _, v := range p.Environment.GetBase().ConsoleBuffer.Lines() {
+		if before != 0 && v.Sequence >= before || v.Sequence <= after {
+			continue
+		}
+		text := cache.ToPlain(v)
+		if query.matchesSource(v) && query.matches(text) {
+			line := createConsoleLine(strconv.FormatUint(v.Sequence, 10), v.Time, text)
+			line.Daemon = v.Source == pufferd.ConsoleSourceDaemon
+			line.Source = v.Source
+			line.Stream = v.Stream
+			matches = append(matches, line)
+		}
+	}
+
+	if query.After != "" {
+		if len(matches) > query.Limit {
+			return matches[:query.Limit], true, nil
+		}
+		return matches, false, nil
+	}
+	if len(matches) > query.Limit {
+		return matches[len(matches)-query.Limit:], true, nil
+	}
+	return matches, false, nil
+}
+
+//File cursors are the name of the segment and the line number within it, as segment:line.
+func (p *Program) queryConsoleFiles(query ConsoleQuery) ([]pufferd.ServerConsoleLine, bool, error) {
+	segments, err := p.getConsoleLogSegments()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if query.After != "" {
+		segment, line, err := parseConsoleFileCursor(query.After)
+		if err != nil {
+			return nil, false, err
+		}
+
+		matches := make([]pufferd.ServerConsoleLine, 0)
+		for _, v := range segments {
+			if v < segment {
+				continue
+			}
+			err = p.scanConsoleLog(v, func(number int, text string) bool {
+				if v == segment && number <= line || !query.matches(text) {
+					return true
+				}
+				matches = append(matches, createConsoleLine(v+":"+strconv.Itoa(number), 0, text))
+				return len(matches) <= query.Limit
+			})
+			if err != nil {
+				return nil, false, err
+			}
+			if len(matches) > query.Limit {
+				return matches[:query.Limit], true, nil
+			}
+		}
+		return matches, false, nil
+	}
+
+	segment, line := "", 0
+	if query.Before != "" {
+		segment, line, err = parseConsoleFileCursor(query.Before)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	//walk back through the segments until there is one more match than needed
+	result := make([]pufferd.ServerConsoleLine, 0)
+	for i := len(segments) - 1; i >= 0 && len(result) <= query.Limit; i-- {
+		v := segments[i]
+		if segment != "" && v > segment {
+			continue
+		}
+
+		matches := make([]pufferd.ServerConsoleLine, 0)
+		err = p.scanConsoleLog(v, func(number int, text string) bool {
+			if v == segment && number >= line {
+				return false
+			}
+			if query.matches(text) {
+				matches = append(matches, createConsoleLine(v+":"+strconv.Itoa(number), 0, text))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		result = append(matches, result...)
+	}
+
+	if len(result) > query.Limit {
+		return result[len(result)-query.Limit:], true, nil
+	}
+	return result, false, nil
+}
+
+//Gets the names of the console log segments, oldest first, without the .gz of compressed segments.
+func (p *Program) getConsoleLogSegments() ([]string, error) {
+	files, err := ioutil.ReadDir(p.getConsoleLogFolder())
+	if err != nil && os.IsNotExist(err) {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	segments := make([]string, 0)
+	for _, file := range files {
+		if file.IsDir() || !envs.IsConsoleLogFile(file.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".gz")
+		if !found[name] {
+			found[name] = true
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+//Calls fn with each line of the segment and its line number, counting from 1, until fn returns false.
+//A segment still being compressed is read from the uncompressed copy.
+func (p *Program) scanConsoleLog(segment string, fn func(number int, text string) bool) error {
+	file, err := p.getConsoleLogFile(segment)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	f, err := os.Open(file)
+	if err != nil && os.IsNotExist(err) {
+		f, err = os.Open(file + ".gz")
+		if err != nil && os.IsNotExist(err) {
+			//removed since it was listed
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer apufferi.Close(f)
+
+		reader, err = gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		defer apufferi.Close(f)
+		reader = f
+	}
+
+	buffered := bufio.NewReader(reader)
+	for number := 1; ; number++ {
+		text, err := buffered.ReadString('\n')
+		if text != "" {
+			if !fn(number, strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func parseConsoleFileCursor(cursor string) (segment string, line int, err error) {
+	i := strings.LastIndex(cursor, ":")
+	if i == -1 {
+		return "", 0, pufferd.ErrInvalidCursor
+	}
+	segment = cursor[:i]
+	line, err = strconv.Atoi(cursor[i+1:])
+	if err != nil || line < 1 || !envs.IsConsoleLogFile(segment) {
+		return "", 0, pufferd.ErrInvalidCursor
+	}
+	return segment, line, nil
+}
+
+func createConsoleLine(cursor string, time int64, text string) pufferd.ServerConsoleLine {
+	return pufferd.ServerConsoleLine{
+		Cursor: cursor,
+		Time:   time,
+		Line:   text,
+	}
+}
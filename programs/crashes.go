@@ -0,0 +1,155 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"encoding/json"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var crashLock = sync.Mutex{}
+
+func (p *Program) getCrashFile() string {
+	return apufferi.JoinPath(viper.GetString("data.crashes"), p.Id()+".json")
+}
+
+//Gets the recorded crashes for this server, newest first.
+func (p *Program) GetCrashes() ([]pufferd.ServerCrash, error) {
+	crashLock.Lock()
+	defer crashLock.Unlock()
+
+	return p.readCrashes()
+}
+
+//Callers must hold crashLock.
+func (p *Program) readCrashes() ([]pufferd.ServerCrash, error) {
+	crashes := make([]pufferd.ServerCrash, 0)
+
+	data, err := ioutil.ReadFile(p.getCrashFile())
+	if os.IsNotExist(err) {
+		return crashes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &crashes)
+	return crashes, err
+}
+
+//Records a crash in this server's history, keeping the last lines of the console with it.
+//Returns how many crashes, including this one, happened within the crash window.
+func (p *Program) recordCrash(crash pufferd.ServerCrash) int {
+	crashLock.Lock()
+	defer crashLock.Unlock()
+
+	p.crashCount++
+
+	lines := viper.GetInt("data.crashConsoleLines")
+	console, _ := p.Environment.GetConsole()
+	if len(console) > lines {
+		console = console[len(console)-lines:]
+	}
+	crash.Console = console
+
+	crashes, err := p.readCrashes()
+	if err != nil {
+		logging.Exception("Error reading crash history for server "+p.Id(), err)
+		crashes = make([]pufferd.ServerCrash, 0)
+	}
+	crashes = append([]pufferd.ServerCrash{crash}, crashes...)
+
+	//always keep enough history to enforce the crash limit
+	limit := viper.GetInt("data.crashHistory")
+	if crashLimit := viper.GetInt("data.crashLimit"); crashLimit+1 > limit {
+		limit = crashLimit + 1
+	}
+	if len(crashes) > limit {
+		crashes = crashes[:limit]
+	}
+
+	if err = p.writeCrashes(crashes); err != nil {
+		logging.Exception("Error saving crash history for server "+p.Id(), err)
+	}
+
+	window := time.Duration(viper.GetInt("data.crashWindow")) * time.Second
+	since := time.Now().Add(-window).Unix()
+	recent := 0
+	for _, v := range crashes {
+		if v.Time >= since {
+			recent++
+		}
+	}
+	return recent
+}
+
+//Callers must hold crashLock.
+func (p *Program) writeCrashes(crashes []pufferd.ServerCrash) error {
+	file := p.getCrashFile()
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(crashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func (p *Program) deleteCrashes() error {
+	crashLock.Lock()
+	defer crashLock.Unlock()
+
+	err := os.Remove(p.getCrashFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Gets how long to wait before restarting after the given number of recent crashes.
+//The delay doubles with each crash, up to data.crashBackoffMax.
+func crashBackoff(recent int) time.Duration {
+	delay := time.Duration(viper.GetInt("data.crashBackoff")) * time.Second
+	max := time.Duration(viper.GetInt("data.crashBackoffMax")) * time.Second
+	for i := 1; i < recent && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+//Queues the server to start after the given delay, unless it has been started or stopped since it crashed.
+func (p *Program) restartAfterCrash(delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		if p.GetState() != StateCrashed {
+			return
+		}
+		StartViaService(p)
+	})
+}
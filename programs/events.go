@@ -0,0 +1,59 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+	"sync"
+	"time"
+)
+
+//Called for each event a server emits. Listeners must not block.
+type EventListener func(p *Program, event pufferd.ServerEvent)
+
+var eventListeners = make([]EventListener, 0)
+var eventLock = sync.Mutex{}
+
+//Adds a listener that is called for every event emitted by any server.
+func AddEventListener(listener EventListener) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventListeners = append(eventListeners, listener)
+}
+
+//Sends a named event to the server's sockets, subscribers and every event listener.
+func (p *Program) emitEvent(name string, data map[string]string) {
+	event := pufferd.ServerEvent{
+		Server: p.Id(),
+		Event:  name,
+		Time:   time.Now().Unix(),
+		Data:   data,
+	}
+
+	if p.Environment != nil {
+		_ = p.Environment.GetBase().WSManager.WriteMessage(messages.EventMessage{ServerEvent: event})
+	}
+	p.publish(messages.EventMessage{ServerEvent: event})
+
+	eventLock.Lock()
+	listeners := eventListeners
+	eventLock.Unlock()
+	for _, listener := range listeners {
+		listener(p, event)
+	}
+}
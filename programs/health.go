@@ -0,0 +1,375 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HealthCheckTcp     = "tcp"
+	HealthCheckHttp    = "http"
+	HealthCheckConsole = "console"
+	HealthCheckCommand = "command"
+)
+
+//Checks a running server is responding.
+//Checks start one interval after the server is running, and the server is unhealthy once a check fails retries times in a row.
+type HealthCheck struct {
+	Type string `json:"type"`
+	//Seconds between checks, and before the first one. Defaults to 30
+	Interval int `json:"interval,omitempty"`
+	//Seconds a check may take. Defaults to 10
+	Timeout int `json:"timeout,omitempty"`
+	//Failures in a row before the server is unhealthy. Defaults to 3
+	Retries int `json:"retries,omitempty"`
+	//Address to connect to for tcp checks. Defaults to the server's ip and port
+	Address string `json:"address,omitempty"`
+	//URL to GET for http checks, which pass on any 2xx or 3xx status. Defaults to the server's ip and port
+	Url string `json:"url,omitempty"`
+	//For console checks, the console must print a line matching this within the timeout
+	Pattern string `json:"pattern,omitempty"`
+	//For console checks, sent to the server first. For command checks, run the way the server's main process is,
+	//passing if it exits with 0. Command checks run on the host, so are only allowed for standard and tty servers,
+	//whose processes already run there
+	Command   string   `json:"command,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+	//Restart the server through the start queue once it is unhealthy
+	Restart  bool `json:"restart,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+type healthState struct {
+	result  pufferd.HealthResult
+	next    time.Time
+	running bool
+}
+
+type consoleWaiter struct {
+	pattern *regexp.Regexp
+	matched chan bool
+}
+
+var healthLock = sync.Mutex{}
+
+//Validates the check has everything its type needs.
+func (h HealthCheck) Validate() error {
+	switch h.Type {
+	case HealthCheckTcp, HealthCheckHttp:
+	case HealthCheckConsole:
+		if _, err := regexp.Compile(h.Pattern); err != nil || h.Pattern == "" {
+			return pufferd.ErrInvalidHealthCheck
+		}
+	case HealthCheckCommand:
+		if h.Command == "" {
+			return pufferd.ErrInvalidHealthCheck
+		}
+	default:
+		return pufferd.ErrInvalidHealthCheck
+	}
+	return nil
+}
+
+func (h HealthCheck) getInterval() time.Duration {
+	if h.Interval <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(h.Interval) * time.Second
+}
+
+func (h HealthCheck) getTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+func (h HealthCheck) getRetries() int {
+	if h.Retries <= 0 {
+		return 3
+	}
+	return h.Retries
+}
+
+//Gets the results of the server's health checks, and whether they are all passing.
+//Checks only run while the server is running, so nothing is returned otherwise.
+func (p *Program) GetHealth() (map[string]pufferd.HealthResult, *bool) {
+	if p.GetState() != StateRunning || len(p.HealthChecks) == 0 {
+		return nil, nil
+	}
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	healthy := true
+	result := make(map[string]pufferd.HealthResult)
+	for name, state := range p.health {
+		result[name] = state.result
+		healthy = healthy && state.result.Healthy
+	}
+	return result, &healthy
+}
+
+//Forgets earlier results, so a server is treated as healthy again, and first checked an interval after it starts.
+//Invalid checks are logged and skipped.
+func (p *Program) resetHealth() {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	p.health = make(map[string]*healthState)
+	now := time.Now()
+	for name, check := range p.HealthChecks {
+		err := check.Validate()
+		if err == nil && check.Type == HealthCheckCommand && !p.runsOnHost() {
+			err = pufferd.ErrNotSupported
+		}
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error loading health check %s for server %s", name, p.Id()), err)
+			continue
+		}
+		p.health[name] = &healthState{result: pufferd.HealthResult{Healthy: true}, next: now.Add(check.getInterval())}
+	}
+}
+
+//Runs the health checks that are due for every running server.
+func collectHealth(now time.Time) {
+	for _, p := range GetAll() {
+		if len(p.HealthChecks) == 0 || p.GetState() != StateRunning {
+			continue
+		}
+
+		healthLock.Lock()
+		for name, check := range p.HealthChecks {
+			state := p.health[name]
+			if check.Disabled || state == nil || state.running || now.Before(state.next) {
+				continue
+			}
+			state.running = true
+			go p.runHealthCheck(name, check, state)
+		}
+		healthLock.Unlock()
+	}
+}
+
+func (p *Program) runHealthCheck(name string, check HealthCheck, state *healthState) {
+	err := p.checkHealth(check)
+
+	healthLock.Lock()
+	state.running = false
+	state.next = time.Now().Add(check.getInterval())
+	state.result.Checked = time.Now().Unix()
+	wasHealthy := state.result.Healthy
+	if err == nil {
+		state.result.Failures = 0
+		state.result.Healthy = true
+		state.result.Error = ""
+	} else {
+		state.result.Failures++
+		state.result.Error = err.Error()
+		if state.result.Failures >= check.getRetries() {
+			state.result.Healthy = false
+		}
+	}
+	result := state.result
+	healthLock.Unlock()
+
+	if err != nil {
+		logging.Debug("Health check %s for server %s failed: %s", name, p.Id(), err.Error())
+	}
+
+	if wasHealthy == result.Healthy {
+		return
+	}
+
+	if result.Healthy {
+		p.Environment.DisplayToConsole(true, "Health check %s is passing again\n", name)
+		p.emitEvent("healthy", map[string]string{"check": name})
+		return
+	}
+
+	p.Environment.DisplayToConsole(true, "Health check %s failed %d times: %s\n", name, result.Failures, result.Error)
+	p.emitEvent("unhealthy", map[string]string{"check": name, "error": result.Error})
+	if check.Restart {
+		go p.restartUnhealthy(check.getTimeout())
+	}
+}
+
+//Stops the server, killing it if it does not stop in time, then queues it to start again.
+func (p *Program) restartUnhealthy(timeout time.Duration) {
+	p.Environment.DisplayToConsole(true, "Restarting unhealthy server\n")
+
+	err := p.sendStop()
+	if err != nil {
+		logging.Exception("Error stopping unhealthy server "+p.Id(), err)
+	}
+	err = p.Environment.WaitForMainProcessFor(int(timeout / time.Millisecond))
+	if err != nil {
+		logging.Exception("Error killing unhealthy server "+p.Id(), err)
+	}
+
+	if state := p.GetState(); state == StateStopped || state == StateCrashed {
+		StartViaService(p)
+	}
+}
+
+func (p *Program) checkHealth(check HealthCheck) error {
+	timeout := check.getTimeout()
+	switch check.Type {
+	case HealthCheckTcp:
+		address := check.Address
+		if address == "" {
+			address = p.getLocalNetwork()
+		}
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		apufferi.Close(conn)
+		return nil
+
+	case HealthCheckHttp:
+		url := check.Url
+		if url == "" {
+			url = "http://" + p.getLocalNetwork() + "/"
+		} else {
+			url = apufferi.ReplaceTokens(url, p.DataToMap())
+		}
+		client := &http.Client{Timeout: timeout}
+		response, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		apufferi.Close(response.Body)
+		if response.StatusCode >= 400 {
+			return fmt.Errorf("status %d from %s", response.StatusCode, url)
+		}
+		return nil
+
+	case HealthCheckConsole:
+		pattern, err := regexp.Compile(check.Pattern)
+		if err != nil {
+			return err
+		}
+		return p.waitForConsole(pattern, check.Command, timeout)
+
+	case HealthCheckCommand:
+		//anything else would run the command outside of the server's isolation
+		if !p.runsOnHost() {
+			return pufferd.ErrNotSupported
+		}
+		data := p.DataToMap()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, check.Command, apufferi.ReplaceTokensInArr(check.Arguments, data)...)
+		cmd.Dir = p.Environment.GetRootDirectory()
+		cmd.Env = append(os.Environ(), "HOME="+cmd.Dir)
+		for k, v := range apufferi.ReplaceTokensInMap(p.Execution.EnvironmentVariables, data) {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && len(strings.TrimSpace(string(output))) > 0 {
+			return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+		}
+		return err
+	}
+	return pufferd.ErrInvalidHealthCheck
+}
+
+//Returns true if the server's processes run directly on the host, as standard and tty servers do.
+func (p *Program) runsOnHost() bool {
+	switch p.Environment.GetBase().Type {
+	case "standard", "tty":
+		return true
+	}
+	return false
+}
+
+//Gets the server's address, using localhost if it listens on every interface.
+func (p *Program) getLocalNetwork() string {
+	host, port, err := net.SplitHostPort(p.GetNetwork())
+	if err != nil {
+		return p.GetNetwork()
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+//Sends the command to the server, if there is one, and waits for a line of output matching the pattern.
+func (p *Program) waitForConsole(pattern *regexp.Regexp, command string, timeout time.Duration) error {
+	waiter := &consoleWaiter{pattern: pattern, matched: make(chan bool, 1)}
+
+	healthLock.Lock()
+	p.consoleWaiters = append(p.consoleWaiters, waiter)
+	healthLock.Unlock()
+
+	defer func() {
+		healthLock.Lock()
+		for i, v := range p.consoleWaiters {
+			if v == waiter {
+				p.consoleWaiters = append(p.consoleWaiters[:i], p.consoleWaiters[i+1:]...)
+				break
+			}
+		}
+		healthLock.Unlock()
+	}()
+
+	if command != "" {
+		if err := p.ExecuteFrom(command, pufferd.CommandSource{Transport: pufferd.CommandTransportHealth}); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-waiter.matched:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no output matching " + pattern.String())
+	}
+}
+
+//Passes a line of output to any console health checks waiting for it.
+func (p *Program) notifyConsoleWaiters(line string) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	for _, v := range p.consoleWaiters {
+		if v.pattern.MatchString(line) {
+			select {
+			case v.matched <- true:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckHealth_CommandRunsLikeTheServer(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"sleep","arguments":["30"],"environmentVars":{"CHECK_VALUE":"expected"}}}`)
+	defer cleanup()
+
+	err := ioutil.WriteFile(filepath.Join(p.Environment.GetRootDirectory(), "marker"), []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := HealthCheck{
+		Type:      HealthCheckCommand,
+		Command:   "sh",
+		Arguments: []string{"-c", `test -f marker && test "$HOME" = "$PWD" && test "$CHECK_VALUE" = expected`},
+	}
+	err = p.checkHealth(check)
+	if err != nil {
+		t.Fatalf("expected check to run in the server's directory with its environment: %s", err)
+	}
+}
+
+func TestCheckHealth_CommandRejectedOutsideHost(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"docker"},"health":{"script":{"type":"command","command":"true"}}}`)
+	defer cleanup()
+
+	err := p.checkHealth(p.HealthChecks["script"])
+	if err != pufferd.ErrNotSupported {
+		t.Fatalf("expected %s for a docker server, got %v", pufferd.ErrNotSupported, err)
+	}
+
+	p.resetHealth()
+	if p.health["script"] != nil {
+		t.Fatal("expected the command check not to be scheduled for a docker server")
+	}
+}
@@ -114,6 +114,7 @@ func LoadFromData(id string, source []byte) (*Program, error) {
 	if err != nil {
 		return nil, err
 	}
+	data.registerRules()
 	return data, nil
 }
 
@@ -158,6 +159,10 @@ func Create(program *Program) error {
 	}
 
 	program.Environment, err = environments.Create(typeMap.Type, ServerFolder, program.Id(), program.Server.Environment)
+	if err != nil {
+		return err
+	}
+	program.registerRules()
 
 	err = program.Create()
 	if err != nil {
@@ -165,6 +170,10 @@ func Create(program *Program) error {
 	}
 
 	allPrograms = append(allPrograms, program)
+
+	scheduleLock.Lock()
+	program.registerSchedules()
+	scheduleLock.Unlock()
 	return nil
 }
 
@@ -194,6 +203,16 @@ func Delete(id string) (err error) {
 		}
 	}
 
+	scheduleLock.Lock()
+	program.unregisterSchedules()
+	scheduleLock.Unlock()
+
+	statsLock.Lock()
+	delete(statsSubscriptions, program)
+	statsLock.Unlock()
+
+	program.closeSubscribers()
+
 	err = program.Destroy()
 	if err != nil {
 		return
@@ -202,6 +221,18 @@ func Delete(id string) (err error) {
 	if err != nil {
 		logging.Exception("error removing server", err)
 	}
+	err = program.deleteCrashes()
+	if err != nil {
+		logging.Exception("error removing crash history", err)
+	}
+	err = program.deleteStatsHistory()
+	if err != nil {
+		logging.Exception("error removing stats history", err)
+	}
+	err = program.deleteConsoleLogs()
+	if err != nil {
+		logging.Exception("error removing console logs", err)
+	}
 	allPrograms = append(allPrograms[:index], allPrograms[index+1:]...)
 	return
 }
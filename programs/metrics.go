@@ -0,0 +1,102 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/metrics"
+	"sync"
+)
+
+var (
+	serverCpuDesc = prometheus.NewDesc("pufferd_server_cpu_percent",
+		"CPU usage of the server, as a percent of one core.", []string{"server"}, nil)
+	serverMemoryDesc = prometheus.NewDesc("pufferd_server_memory_bytes",
+		"Memory used by the server.", []string{"server"}, nil)
+	serverMemoryLimitDesc = prometheus.NewDesc("pufferd_server_memory_limit_bytes",
+		"Memory available to the server.", []string{"server"}, nil)
+	serverUptimeDesc = prometheus.NewDesc("pufferd_server_uptime_seconds",
+		"Time since the server process was started.", []string{"server"}, nil)
+	serverRunningDesc = prometheus.NewDesc("pufferd_server_running",
+		"Whether the server is running, with its current state.", []string{"server", "state"}, nil)
+	serverCrashesDesc = prometheus.NewDesc("pufferd_server_crashes_total",
+		"Crashes recorded for the server since the daemon started.", []string{"server"}, nil)
+	serverConsoleLinesDesc = prometheus.NewDesc("pufferd_server_console_lines_total",
+		"Console lines written by the server since the daemon started.", []string{"server"}, nil)
+)
+
+type serverCollector struct{}
+
+func init() {
+	metrics.Register(serverCollector{})
+}
+
+func (serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- serverCpuDesc
+	ch <- serverMemoryDesc
+	ch <- serverMemoryLimitDesc
+	ch <- serverUptimeDesc
+	ch <- serverRunningDesc
+	ch <- serverCrashesDesc
+	ch <- serverConsoleLinesDesc
+}
+
+//Samples every server in parallel, so one slow environment does not hold up the scrape for each of the others.
+func (serverCollector) Collect(ch chan<- prometheus.Metric) {
+	wg := sync.WaitGroup{}
+	for _, p := range GetAll() {
+		wg.Add(1)
+		go func(p *Program) {
+			defer wg.Done()
+			p.collectMetrics(ch)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (p *Program) collectMetrics(ch chan<- prometheus.Metric) {
+	id := p.Id()
+	state := p.GetState()
+
+	running := 0.0
+	if state == StateRunning || state == StateStarting || state == StateStopping {
+		running = 1
+	}
+	ch <- prometheus.MustNewConstMetric(serverRunningDesc, prometheus.GaugeValue, running, id, string(state))
+
+	crashLock.Lock()
+	crashes := p.crashCount
+	crashLock.Unlock()
+	ch <- prometheus.MustNewConstMetric(serverCrashesDesc, prometheus.CounterValue, float64(crashes), id)
+
+	lines := p.Environment.GetBase().ConsoleLines.Count()
+	ch <- prometheus.MustNewConstMetric(serverConsoleLinesDesc, prometheus.CounterValue, float64(lines), id)
+
+	if running == 0 {
+		return
+	}
+
+	stats, err := p.GetStats()
+	if err != nil || stats == nil {
+		stats = &pufferd.ServerStats{}
+	}
+	ch <- prometheus.MustNewConstMetric(serverCpuDesc, prometheus.GaugeValue, stats.Cpu, id)
+	ch <- prometheus.MustNewConstMetric(serverMemoryDesc, prometheus.GaugeValue, float64(stats.Memory), id)
+	ch <- prometheus.MustNewConstMetric(serverMemoryLimitDesc, prometheus.GaugeValue, float64(stats.MemoryLimit), id)
+	ch <- prometheus.MustNewConstMetric(serverUptimeDesc, prometheus.GaugeValue, float64(stats.Uptime), id)
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/pufferd/v2"
 	"github.com/pufferpanel/pufferd/v2/environments/envs"
+	"github.com/pufferpanel/pufferd/v2/metrics"
 	"github.com/pufferpanel/pufferd/v2/programs/operations/impl/command"
 	"github.com/pufferpanel/pufferd/v2/programs/operations/impl/download"
 	"github.com/pufferpanel/pufferd/v2/programs/operations/impl/forgedl"
@@ -30,6 +31,7 @@ import (
 	"github.com/pufferpanel/pufferd/v2/programs/operations/impl/writefile"
 	"github.com/pufferpanel/pufferd/v2/programs/operations/ops"
 	"github.com/spf13/cast"
+	"time"
 )
 
 var commandMapping map[string]ops.OperationFactory
@@ -50,6 +52,7 @@ func GenerateProcess(directions []interface{}, environment envs.Environment, dat
 
 	dataMap["rootDir"] = environment.GetRootDirectory()
 	operationList := make([]ops.Operation, 0)
+	operationTypes := make([]string, 0)
 	for _, mapping := range directions {
 
 		var typeMap apufferi.MetadataType
@@ -106,12 +109,14 @@ func GenerateProcess(directions []interface{}, environment envs.Environment, dat
 		op := factory.Create(opCreate)
 
 		operationList = append(operationList, op)
+		operationTypes = append(operationTypes, typeMap.Type)
 	}
-	return OperationProcess{processInstructions: operationList}, nil
+	return OperationProcess{processInstructions: operationList, processTypes: operationTypes}, nil
 }
 
 type OperationProcess struct {
 	processInstructions []ops.Operation
+	processTypes        []string
 }
 
 func (p *OperationProcess) Run(env envs.Environment) (err error) {
@@ -126,8 +131,15 @@ func (p *OperationProcess) Run(env envs.Environment) (err error) {
 
 func (p *OperationProcess) RunNext(env envs.Environment) error {
 	var op ops.Operation
+	var opType string
 	op, p.processInstructions = p.processInstructions[0], p.processInstructions[1:]
+	opType, p.processTypes = p.processTypes[0], p.processTypes[1:]
+	env.GetBase().SetConsoleSource(opType)
+	defer env.GetBase().SetConsoleSource("")
+
+	start := time.Now()
 	err := op.Run(env)
+	metrics.ObserveOperation(opType, time.Since(start))
 	return err
 }
 
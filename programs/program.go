@@ -26,19 +26,67 @@ import (
 	"github.com/pufferpanel/pufferd/v2/messages"
 	"github.com/pufferpanel/pufferd/v2/programs/operations"
 	"github.com/spf13/viper"
+	"gopkg.in/robfig/cron.v2"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type Program struct {
 	apufferi.Server
 
-	CrashCounter int
-	Environment  envs.Environment
+	Execution Execution           `json:"run"`
+	Schedules map[string]Schedule `json:"schedules,omitempty"`
+	Backup    BackupSettings      `json:"backup"`
+	Rules     []ConsoleRule       `json:"rules,omitempty"`
+
+	HealthChecks map[string]HealthCheck `json:"health,omitempty"`
+
+	Environment envs.Environment
+
+	scheduleIds []cron.EntryID
+	restartLock sync.Mutex
+
+	//Held while the main process is started, and while a stop is escalated, so escalation never signals a newer process
+	runLock sync.Mutex
+	//Closed once the main process started last has exited and its state has been recorded
+	processExited chan struct{}
+	//Closed when the pending stop escalation, if any, is cancelled
+	stopCancel chan struct{}
+
+	state     State
+	lastExit  *pufferd.ExitStatus
+	stateLock sync.Mutex
+
+	crashCount uint64
+
+	compiledRules []*compiledRule
+
+	health         map[string]*healthState
+	consoleWaiters []*consoleWaiter
+
+	lastStats     *pufferd.ServerStats
+	lastStatsTime time.Time
+	statsLock     sync.Mutex
+}
+
+type Execution struct {
+	apufferi.Execution
+
+	//Seconds to wait after asking the server to stop before sending SIGTERM, and again before killing it.
+	//data.stopTimeout is used when this is not set
+	StopTimeout int `json:"stopTimeout,omitempty"`
+}
+
+//A stop sent to the main process that was running when it was sent.
+type stopRequest struct {
+	exited <-chan struct{}
+	cancel <-chan struct{}
 }
 
 var queue *list.List
@@ -51,6 +99,8 @@ func InitService() {
 	ticker = time.NewTicker(1 * time.Second)
 	running = true
 	go processQueue()
+	startScheduler()
+	startStatsCollector()
 }
 
 func StartViaService(p *Program) {
@@ -59,9 +109,15 @@ func StartViaService(p *Program) {
 		lock.Unlock()
 	}()
 
-	if running {
-		queue.PushBack(p)
+	if !running {
+		return
+	}
+
+	if err := p.transition("queue", StateQueued, StateStopped, StateCrashed); err != nil {
+		logging.Exception("Error queueing server "+p.Id(), err)
+		return
 	}
+	queue.PushBack(p)
 }
 
 func ShutdownService() {
@@ -72,6 +128,8 @@ func ShutdownService() {
 
 	running = false
 	ticker.Stop()
+	stopScheduler()
+	stopStatsCollector()
 }
 
 func processQueue() {
@@ -91,6 +149,8 @@ func processQueue() {
 			if err != nil {
 				logging.Exception("Error starting server "+program.Id(), err)
 			}
+		} else {
+			_ = program.transition("start", StateRunning, StateQueued)
 		}
 	}
 }
@@ -115,6 +175,13 @@ func (p *Program) DataToMap() map[string]interface{} {
 func CreateProgram() *Program {
 	return &Program{
 		Server: apufferi.Server{
+			Type:           "standard",
+			Variables:      make(map[string]apufferi.Variable, 0),
+			Display:        "Unknown server",
+			Installation:   make([]interface{}, 0),
+			Uninstallation: make([]interface{}, 0),
+		},
+		Execution: Execution{
 			Execution: apufferi.Execution{
 				Disabled:                false,
 				AutoStart:               false,
@@ -124,12 +191,8 @@ func CreateProgram() *Program {
 				PostExecution:           make([]interface{}, 0),
 				EnvironmentVariables:    make(map[string]string, 0),
 			},
-			Type:           "standard",
-			Variables:      make(map[string]apufferi.Variable, 0),
-			Display:        "Unknown server",
-			Installation:   make([]interface{}, 0),
-			Uninstallation: make([]interface{}, 0),
 		},
+		Schedules: make(map[string]Schedule),
 	}
 }
 
@@ -144,6 +207,21 @@ func (p *Program) Start() (err error) {
 		return err
 	}
 
+	err = p.transition("start", StateStarting, StateStopped, StateCrashed, StateQueued)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			p.setState(StateStopped)
+		}
+	}()
+
+	//a stop still escalating belongs to a process that has exited, and must not reach the one being started
+	p.runLock.Lock()
+	p.cancelStop()
+	p.runLock.Unlock()
+
 	logging.Debug("Starting server %s", p.Id())
 	p.Environment.DisplayToConsole(true, "Starting server\n")
 	data := make(map[string]interface{})
@@ -170,30 +248,96 @@ func (p *Program) Start() (err error) {
 	//HACK: add rootDir stuff
 	data["rootDir"] = p.Environment.GetRootDirectory()
 
-	err = p.Environment.ExecuteAsync(p.Execution.ProgramName, apufferi.ReplaceTokensInArr(p.Execution.Arguments, data), apufferi.ReplaceTokensInMap(p.Execution.EnvironmentVariables, data), p.afterExit)
+	exited := make(chan struct{})
+	p.runLock.Lock()
+	err = p.Environment.ExecuteAsync(p.Execution.ProgramName, apufferi.ReplaceTokensInArr(p.Execution.Arguments, data), apufferi.ReplaceTokensInMap(p.Execution.EnvironmentVariables, data), func(status pufferd.ExitStatus) {
+		p.afterExit(status, exited)
+	})
+	if err == nil {
+		p.processExited = exited
+	}
+	p.runLock.Unlock()
 	if err != nil {
 		logging.Exception("error starting server "+p.Id(), err)
 		p.Environment.DisplayToConsole(true, " Failed to start server\n")
 		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		return
 	}
 
+	p.emitEvent("started", nil)
+
+	if p.hasReadyRule() {
+		p.Environment.DisplayToConsole(true, "Waiting for server to be ready\n")
+	} else {
+		_ = p.transition("start", StateRunning, StateStarting)
+	}
 	return
 }
 
 //Stops the program.
 //This will also stop the environment it is ran in.
 func (p *Program) Stop() (err error) {
+	stop := p.beginStop()
+	err = p.sendStop()
+	if err == nil {
+		if timeout := p.GetStopTimeout(); timeout > 0 {
+			go func() {
+				if err := p.escalateStop(stop, timeout); err != nil {
+					logging.Exception("Error stopping server "+p.Id(), err)
+				}
+			}()
+		}
+	}
+	return
+}
+
+//Stops the program and waits for it to exit, escalating the stop if it has not exited within its stop timeout.
+func (p *Program) StopAndWait() (err error) {
+	stop := p.beginStop()
+	err = p.sendStop()
+	if err != nil {
+		return
+	}
+
+	if timeout := p.GetStopTimeout(); timeout > 0 {
+		return p.escalateStop(stop, timeout)
+	}
+	select {
+	case <-stop.exited:
+	case <-stop.cancel:
+	}
+	return
+}
+
+//Gets the seconds to wait for the server to stop before escalating, which is data.stopTimeout unless the server sets its own.
+func (p *Program) GetStopTimeout() int {
+	if p.Execution.StopTimeout > 0 {
+		return p.Execution.StopTimeout
+	}
+	return viper.GetInt("data.stopTimeout")
+}
+
+//Sends the stop command or code to the main process, if it is running.
+func (p *Program) sendStop() (err error) {
 	if running, err := p.IsRunning(); !running || err != nil {
 		return err
 	}
 
+	previous := p.GetState()
+	err = p.transition("stop", StateStopping, StateRunning, StateStarting, StateStopping)
+	if err != nil {
+		return
+	}
+
 	logging.Debug("Stopping server %s", p.Id())
 	if p.Execution.StopCode != 0 {
 		err = p.Environment.SendCode(p.Execution.StopCode)
 	} else {
-		err = p.Environment.ExecuteInMainProcess(p.Execution.StopCommand)
+		err = p.ExecuteFrom(p.Execution.StopCommand, pufferd.CommandSource{Transport: pufferd.CommandTransportDaemon})
 	}
 	if err != nil {
+		//the server was never told to stop, so it is still in the state it was in, unless it has exited since
+		_ = p.transition("stop", previous, StateStopping)
 		logging.Exception("Error stopping server", err)
 		p.Environment.DisplayToConsole(true, "Failed to stop server\n")
 		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
@@ -203,12 +347,139 @@ func (p *Program) Stop() (err error) {
 	return
 }
 
+//Cancels any escalation pending for an earlier stop, and returns a stop for the process running now.
+func (p *Program) beginStop() stopRequest {
+	p.runLock.Lock()
+	defer p.runLock.Unlock()
+
+	p.cancelStop()
+	p.stopCancel = make(chan struct{})
+
+	exited := p.processExited
+	if exited == nil {
+		//nothing has been started, so there is nothing to wait for
+		closed := make(chan struct{})
+		close(closed)
+		exited = closed
+	}
+	return stopRequest{exited: exited, cancel: p.stopCancel}
+}
+
+//Cancels the pending stop escalation, if any. Callers must hold runLock.
+func (p *Program) cancelStop() {
+	if p.stopCancel != nil {
+		close(p.stopCancel)
+		p.stopCancel = nil
+	}
+}
+
+//Escalates a stop if the process it was sent to has not exited within the timeout (in seconds).
+//The process is sent SIGTERM, and is killed if it still has not exited after another timeout.
+//Nothing is sent once the process has exited or the stop has been cancelled by the server starting again.
+func (p *Program) escalateStop(stop stopRequest, timeout int) error {
+	wait := time.Duration(timeout) * time.Second
+	if stop.wait(wait) {
+		return nil
+	}
+
+	logging.Warn("Server %s did not stop after %d seconds, sending SIGTERM", p.Id(), timeout)
+	p.Environment.DisplayToConsole(true, "Server did not stop after %d seconds, sending SIGTERM\n", timeout)
+	err := p.signalStop(stop, func() error {
+		return p.Environment.SendCode(int(syscall.SIGTERM))
+	})
+	if err != nil {
+		logging.Exception("Error sending SIGTERM to server "+p.Id(), err)
+		p.Environment.DisplayToConsole(true, "Failed to send SIGTERM\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+	}
+
+	p.Environment.DisplayToConsole(true, "Server will be killed if it has not stopped in %d seconds\n", timeout)
+	if stop.wait(wait) {
+		return nil
+	}
+
+	logging.Warn("Server %s killed after not responding to SIGTERM", p.Id())
+	err = p.signalStop(stop, p.Environment.Kill)
+	if err != nil {
+		logging.Exception("Error killing server "+p.Id(), err)
+		p.Environment.DisplayToConsole(true, "Failed to kill server\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		return err
+	}
+	p.Environment.DisplayToConsole(true, "Server killed\n")
+
+	if stop.wait(wait) {
+		return nil
+	}
+	return pufferd.ErrStopTimeout
+}
+
+//Sends a signal for the stop, unless the process it was sent to has already exited or the stop was cancelled.
+func (p *Program) signalStop(stop stopRequest, signal func() error) error {
+	p.runLock.Lock()
+	defer p.runLock.Unlock()
+
+	select {
+	case <-stop.exited:
+		return nil
+	case <-stop.cancel:
+		return nil
+	default:
+		return signal()
+	}
+}
+
+//Waits for the stopped process to exit, returning false if it is still running after the timeout.
+//A cancelled stop is treated as exited, as the server has been started again since.
+func (s stopRequest) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.exited:
+		return true
+	case <-s.cancel:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//Restarts the program.
+//This stops the program, waits for it to exit, and starts it again. Restarts are serialised per program.
+func (p *Program) Restart() (err error) {
+	p.restartLock.Lock()
+	defer p.restartLock.Unlock()
+
+	logging.Debug("Restarting server %s", p.Id())
+	running, err := p.IsRunning()
+	if err != nil {
+		return
+	}
+
+	if running {
+		//waits here rather than leaving the stop to escalate in the background, where it could reach the new process
+		err = p.StopAndWait()
+		if err != nil {
+			logging.Exception("Error waiting for server to stop", err)
+			p.Environment.DisplayToConsole(true, "Failed to restart server\n")
+			p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+			return
+		}
+	}
+
+	return p.Start()
+}
+
 //Kills the program.
 //This will also stop the environment it is ran in.
 func (p *Program) Kill() (err error) {
 	logging.Debug("Killing server %s", p.Id())
+	previous := p.GetState()
+	_ = p.transition("kill", StateStopping, StateRunning, StateStarting, StateStopping)
 	err = p.Environment.Kill()
 	if err != nil {
+		_ = p.transition("kill", previous, StateStopping)
 		logging.Exception("Error killing server", err)
 		p.Environment.DisplayToConsole(true, "Failed to kill server\n")
 		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
@@ -236,6 +507,22 @@ func (p *Program) Create() (err error) {
 	return
 }
 
+//Updates the environment, such as downloading a newer image for docker.
+func (p *Program) Update() (err error) {
+	logging.Debug("Updating server %s", p.Id())
+	p.Environment.DisplayToConsole(true, "Updating server environment\n")
+	err = p.Environment.Update()
+	if err != nil {
+		logging.Exception("Error updating server", err)
+		p.Environment.DisplayToConsole(true, "Failed to update server environment\n")
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+	} else {
+		p.Environment.DisplayToConsole(true, "Server environment updated\n")
+	}
+
+	return
+}
+
 //Destroys the server.
 //This will delete the server, environment, and any files related to it.
 func (p *Program) Destroy() (err error) {
@@ -280,18 +567,25 @@ func (p *Program) Install() (err error) {
 	}
 
 	if running {
-		err = p.Stop()
+		return pufferd.CreateErrInvalidState(string(StateRunning), "install")
 	}
 
+	err = p.transition("install", StateInstalling, StateStopped, StateCrashed)
 	if err != nil {
-		logging.Exception("Error stopping server", err)
-		p.Environment.DisplayToConsole(true, "Failed to stop server\n")
-		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
 		return
 	}
+	defer p.setState(StateStopped)
 
 	p.Environment.DisplayToConsole(true, "Installing server\n")
 
+	defer func() {
+		if err != nil {
+			p.emitEvent("installFailed", map[string]string{"error": err.Error()})
+		} else {
+			p.emitEvent("installed", nil)
+		}
+	}()
+
 	err = os.MkdirAll(p.Environment.GetRootDirectory(), 0755)
 	if err != nil && !os.IsExist(err) {
 		logging.Exception("Error creating server directory", err)
@@ -429,23 +723,78 @@ func (p *Program) CopyFrom(s *Program) {
 	p.Variables = s.Variables
 	p.Execution = s.Execution
 	p.Display = s.Display
+	//keep writing to the same console log, rather than starting a new segment on every reload,
+	//and to the sockets already open
+	if p.Environment != nil && s.Environment != nil {
+		s.Environment.GetBase().ConsoleLog = p.Environment.GetBase().ConsoleLog
+		s.Environment.GetBase().WSManager = p.Environment.GetBase().WSManager
+	}
 	p.Environment = s.Environment
 	p.Installation = s.Installation
 	p.Uninstallation = s.Uninstallation
 	p.Type = s.Type
+	p.Backup = s.Backup
+	p.Rules = s.Rules
+	p.registerRules()
+	p.HealthChecks = s.HealthChecks
+	p.resetHealth()
+
+	scheduleLock.Lock()
+	p.Schedules = s.Schedules
+	p.registerSchedules()
+	scheduleLock.Unlock()
 }
 
-func (p *Program) afterExit(graceful bool) {
-	if graceful {
-		p.CrashCounter = 0
+func (p *Program) afterExit(status pufferd.ExitStatus, exited chan struct{}) {
+	graceful := status.Graceful
+	crashed := !graceful && p.GetState() != StateStopping
+
+	p.stateLock.Lock()
+	p.lastExit = &status
+	p.stateLock.Unlock()
+
+	if status.OOMKilled {
+		p.Environment.DisplayToConsole(true, "Server was killed for running out of memory\n")
+	} else if status.Signal != "" {
+		p.Environment.DisplayToConsole(true, "Server was terminated by signal: %s\n", status.Signal)
+	} else if !graceful {
+		p.Environment.DisplayToConsole(true, "Server exited with code %d\n", status.ExitCode)
+	}
+
+	exitData := map[string]string{
+		"exitCode":  strconv.Itoa(status.ExitCode),
+		"signal":    status.Signal,
+		"oomKilled": strconv.FormatBool(status.OOMKilled),
 	}
 
+	recentCrashes := 0
+	if crashed {
+		recentCrashes = p.recordCrash(pufferd.ServerCrash{ExitStatus: status, Time: time.Now().Unix()})
+		p.setState(StateCrashed)
+		p.emitEvent("crashed", exitData)
+	} else {
+		p.setState(StateStopped)
+		p.emitEvent("stopped", exitData)
+	}
+	close(exited)
+
+	//post-execution commands run in the environment, which waits for this process to be released first
+	go p.runPostExecution(status, crashed, recentCrashes)
+}
+
+//Runs the post-execution steps for a main process that has exited, then restarts the server if it should be.
+func (p *Program) runPostExecution(status pufferd.ExitStatus, crashed bool, recentCrashes int) {
+	graceful := status.Graceful
+
 	mapping := p.DataToMap()
 	mapping["success"] = graceful
+	mapping["exitCode"] = status.ExitCode
+	mapping["signal"] = status.Signal
+	mapping["oomKilled"] = status.OOMKilled
 
 	processes, err := operations.GenerateProcess(p.Execution.PostExecution, p.Environment, mapping, p.Execution.EnvironmentVariables)
 	if err != nil {
-		logging.Exception("Error running post processing for server " + p.Id(), err)
+		logging.Exception("Error running post processing for server "+p.Id(), err)
 		p.Environment.DisplayToConsole(true, "Failed to run post-execution steps\n")
 		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
 		return
@@ -467,9 +816,15 @@ func (p *Program) afterExit(graceful bool) {
 
 	if graceful && p.Execution.AutoRestartFromGraceful {
 		StartViaService(p)
-	} else if !graceful && p.Execution.AutoRestartFromCrash && p.CrashCounter < viper.GetInt("data.crashLimit") {
-		p.CrashCounter++
-		StartViaService(p)
+	} else if crashed && p.Execution.AutoRestartFromCrash {
+		if recentCrashes > viper.GetInt("data.crashLimit") {
+			p.Environment.DisplayToConsole(true, "Server crashed %d times in %d seconds, not restarting\n", recentCrashes, viper.GetInt("data.crashWindow"))
+			p.emitEvent("restartLimitReached", map[string]string{"crashes": strconv.Itoa(recentCrashes)})
+			return
+		}
+		delay := crashBackoff(recentCrashes)
+		p.Environment.DisplayToConsole(true, "Server crashed, restarting in %s\n", delay)
+		p.restartAfterCrash(delay)
 	}
 }
 
@@ -0,0 +1,213 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/programs/operations"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const (
+	RuleActionRestart    = "restart"
+	RuleActionStop       = "stop"
+	RuleActionKill       = "kill"
+	RuleActionCommand    = "command"
+	RuleActionOperations = "operations"
+)
+
+//Matches lines of the server's output.
+//A match emits the event, if one is named, with the line and the pattern's capture groups as its data,
+//and then runs the action, if one is given.
+type ConsoleRule struct {
+	Pattern string `json:"pattern"`
+	Event   string `json:"event,omitempty"`
+	//A match moves the server from starting to running. While a server has a ready rule,
+	//it stays starting after its process starts until one matches.
+	Ready      bool          `json:"ready,omitempty"`
+	Action     string        `json:"action,omitempty"`
+	Command    string        `json:"command,omitempty"`
+	Operations []interface{} `json:"operations,omitempty"`
+	Disabled   bool          `json:"disabled,omitempty"`
+}
+
+type compiledRule struct {
+	ConsoleRule
+	pattern *regexp.Regexp
+	running bool
+}
+
+var ruleLock = sync.Mutex{}
+
+//Validates the rule's pattern compiles and it has everything its action needs.
+func (r ConsoleRule) Validate() error {
+	if _, err := regexp.Compile(r.Pattern); err != nil || r.Pattern == "" {
+		return pufferd.ErrInvalidConsoleRule
+	}
+
+	switch r.Action {
+	case "", RuleActionRestart, RuleActionStop, RuleActionKill:
+	case RuleActionCommand:
+		if r.Command == "" {
+			return pufferd.ErrInvalidConsoleRule
+		}
+	case RuleActionOperations:
+		if len(r.Operations) == 0 {
+			return pufferd.ErrInvalidConsoleRule
+		}
+	default:
+		return pufferd.ErrInvalidConsoleRule
+	}
+
+	if r.Event == "" && r.Action == "" && !r.Ready {
+		return pufferd.ErrInvalidConsoleRule
+	}
+	return nil
+}
+
+//Compiles the program's rules and has its environment pass it each line of output.
+//Invalid rules are logged and skipped.
+func (p *Program) registerRules() {
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	p.compiledRules = make([]*compiledRule, 0, len(p.Rules))
+	for i, rule := range p.Rules {
+		if rule.Disabled {
+			continue
+		}
+		if err := rule.Validate(); err != nil {
+			logging.Exception(fmt.Sprintf("Error loading console rule %d for server %s", i, p.Id()), err)
+			continue
+		}
+		p.compiledRules = append(p.compiledRules, &compiledRule{ConsoleRule: rule, pattern: regexp.MustCompile(rule.Pattern)})
+	}
+
+	if p.Environment != nil {
+		p.Environment.GetBase().LineListener = p.handleConsoleLine
+	}
+}
+
+func (p *Program) hasReadyRule() bool {
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	for _, rule := range p.compiledRules {
+		if rule.Ready {
+			return true
+		}
+	}
+	return false
+}
+
+//Publishes a finished line of output to subscribers and checks it against the rules. Daemon messages are never matched.
+func (p *Program) handleConsoleLine(line pufferd.ConsoleLine) {
+	p.publishConsoleLine(line)
+
+	if line.Source == pufferd.ConsoleSourceDaemon {
+		return
+	}
+
+	p.notifyConsoleWaiters(line.Line)
+
+	ruleLock.Lock()
+	rules := p.compiledRules
+	ruleLock.Unlock()
+
+	for _, rule := range rules {
+		matches := rule.pattern.FindStringSubmatch(line.Line)
+		if matches == nil {
+			continue
+		}
+
+		data := map[string]string{"line": line.Line}
+		for i, name := range rule.pattern.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			data[name] = matches[i]
+		}
+
+		if rule.Event != "" {
+			p.emitEvent(rule.Event, data)
+		}
+		if rule.Ready && p.transition("ready", StateRunning, StateStarting) == nil {
+			p.Environment.DisplayToConsole(true, "Server is ready\n")
+		}
+		if rule.Action != "" {
+			p.runRuleAction(rule, data)
+		}
+	}
+}
+
+//Runs the action in the background. A rule's action is not run again while it is still running,
+//so output from the action itself cannot trigger it in a loop.
+func (p *Program) runRuleAction(rule *compiledRule, data map[string]string) {
+	ruleLock.Lock()
+	if rule.running {
+		ruleLock.Unlock()
+		return
+	}
+	rule.running = true
+	ruleLock.Unlock()
+
+	go func() {
+		defer func() {
+			ruleLock.Lock()
+			rule.running = false
+			ruleLock.Unlock()
+		}()
+
+		logging.Debug("Running console rule action %s for server %s", rule.Action, p.Id())
+
+		var err error
+		switch rule.Action {
+		case RuleActionRestart:
+			p.Environment.DisplayToConsole(true, "Restarting server after matching %s\n", rule.Pattern)
+			err = p.Restart()
+		case RuleActionStop:
+			err = p.Stop()
+		case RuleActionKill:
+			err = p.Kill()
+		case RuleActionCommand:
+			err = p.ExecuteFrom(rule.Command, pufferd.CommandSource{Transport: pufferd.CommandTransportRule})
+		case RuleActionOperations:
+			mapping := p.DataToMap()
+			for k, v := range data {
+				mapping[k] = v
+			}
+			var process operations.OperationProcess
+			process, err = operations.GenerateProcess(rule.Operations, p.Environment, mapping, p.Execution.EnvironmentVariables)
+			if err == nil {
+				err = process.Run(p.Environment)
+			}
+		}
+
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error running console rule action %s for server %s", rule.Action, p.Id()), err)
+			p.Environment.DisplayToConsole(true, "Failed to run console rule action %s\n", rule.Action)
+			p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,216 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"fmt"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/programs/operations"
+	"gopkg.in/robfig/cron.v2"
+	"sync"
+)
+
+const (
+	ScheduleActionStart      = "start"
+	ScheduleActionStop       = "stop"
+	ScheduleActionRestart    = "restart"
+	ScheduleActionCommand    = "command"
+	ScheduleActionOperations = "operations"
+	ScheduleActionBackup     = "backup"
+)
+
+type Schedule struct {
+	Cron       string        `json:"cron"`
+	Action     string        `json:"action"`
+	Command    string        `json:"command,omitempty"`
+	Operations []interface{} `json:"operations,omitempty"`
+	Disabled   bool          `json:"disabled,omitempty"`
+}
+
+var scheduler *cron.Cron
+var scheduleLock = sync.Mutex{}
+
+func startScheduler() {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	scheduler = cron.New()
+	scheduler.Start()
+
+	for _, p := range allPrograms {
+		p.registerSchedules()
+	}
+}
+
+func stopScheduler() {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	if scheduler == nil {
+		return
+	}
+	scheduler.Stop()
+	scheduler = nil
+}
+
+//Validates the schedule can be parsed and has everything its action needs.
+func (s Schedule) Validate() error {
+	if _, err := cron.Parse(s.Cron); err != nil {
+		return pufferd.ErrInvalidSchedule
+	}
+
+	switch s.Action {
+	case ScheduleActionStart, ScheduleActionStop, ScheduleActionRestart, ScheduleActionBackup:
+		return nil
+	case ScheduleActionCommand:
+		if s.Command == "" {
+			return pufferd.ErrInvalidSchedule
+		}
+	case ScheduleActionOperations:
+		if len(s.Operations) == 0 {
+			return pufferd.ErrInvalidSchedule
+		}
+	default:
+		return pufferd.ErrInvalidSchedule
+	}
+	return nil
+}
+
+func (p *Program) GetSchedules() map[string]Schedule {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	result := make(map[string]Schedule, len(p.Schedules))
+	for k, v := range p.Schedules {
+		result[k] = v
+	}
+	return result
+}
+
+//Replaces all schedules for this program and saves the server.
+func (p *Program) SetSchedules(schedules map[string]Schedule) error {
+	for _, v := range schedules {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	scheduleLock.Lock()
+	p.Schedules = schedules
+	p.registerSchedules()
+	scheduleLock.Unlock()
+
+	return Save(p.Id())
+}
+
+//Adds or replaces a single schedule and saves the server.
+func (p *Program) SetSchedule(name string, schedule Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	scheduleLock.Lock()
+	if p.Schedules == nil {
+		p.Schedules = make(map[string]Schedule)
+	}
+	p.Schedules[name] = schedule
+	p.registerSchedules()
+	scheduleLock.Unlock()
+
+	return Save(p.Id())
+}
+
+func (p *Program) DeleteSchedule(name string) error {
+	scheduleLock.Lock()
+	if _, exists := p.Schedules[name]; !exists {
+		scheduleLock.Unlock()
+		return pufferd.ErrScheduleNotFound
+	}
+	delete(p.Schedules, name)
+	p.registerSchedules()
+	scheduleLock.Unlock()
+
+	return Save(p.Id())
+}
+
+//Replaces the scheduled entries for this program with its current schedules.
+//Callers must hold scheduleLock.
+func (p *Program) registerSchedules() {
+	p.unregisterSchedules()
+
+	if scheduler == nil {
+		return
+	}
+
+	for name, schedule := range p.Schedules {
+		if schedule.Disabled {
+			continue
+		}
+		n, s := name, schedule
+		id, err := scheduler.AddFunc(s.Cron, func() {
+			p.runSchedule(n, s)
+		})
+		if err != nil {
+			logging.Exception(fmt.Sprintf("Error scheduling %s for server %s", n, p.Id()), err)
+			continue
+		}
+		p.scheduleIds = append(p.scheduleIds, id)
+	}
+}
+
+//Removes any scheduled entries for this program.
+//Callers must hold scheduleLock.
+func (p *Program) unregisterSchedules() {
+	if scheduler != nil {
+		for _, id := range p.scheduleIds {
+			scheduler.Remove(id)
+		}
+	}
+	p.scheduleIds = nil
+}
+
+func (p *Program) runSchedule(name string, schedule Schedule) {
+	logging.Debug("Running schedule %s for server %s", name, p.Id())
+	p.Environment.DisplayToConsole(true, "Running scheduled task %s\n", name)
+
+	var err error
+	switch schedule.Action {
+	case ScheduleActionStart:
+		err = p.Start()
+	case ScheduleActionStop:
+		err = p.Stop()
+	case ScheduleActionRestart:
+		err = p.Restart()
+	case ScheduleActionCommand:
+		err = p.ExecuteFrom(schedule.Command, pufferd.CommandSource{Transport: pufferd.CommandTransportSchedule})
+	case ScheduleActionOperations:
+		var process operations.OperationProcess
+		process, err = operations.GenerateProcess(schedule.Operations, p.Environment, p.DataToMap(), p.Execution.EnvironmentVariables)
+		if err == nil {
+			err = process.Run(p.Environment)
+		}
+	case ScheduleActionBackup:
+		_, err = p.CreateBackup()
+	}
+
+	if err != nil {
+		logging.Exception(fmt.Sprintf("Error running schedule %s for server %s", name, p.Id()), err)
+		p.Environment.DisplayToConsole(true, "Failed to run scheduled task %s\n", name)
+		p.Environment.DisplayToConsole(true, "%s\n", err.Error())
+	}
+}
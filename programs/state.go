@@ -0,0 +1,109 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+)
+
+type State string
+
+const (
+	StateInstalling State = "installing"
+	StateRestoring  State = "restoring"
+	StateStopped    State = "stopped"
+	StateStarting   State = "starting"
+	StateRunning    State = "running"
+	StateStopping   State = "stopping"
+	StateCrashed    State = "crashed"
+	StateQueued     State = "queued"
+	StateDisabled   State = "disabled"
+)
+
+func (p *Program) GetState() State {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.getState()
+}
+
+//Gets how the main process last exited, or nil if it has not exited since the daemon started.
+func (p *Program) GetLastExit() *pufferd.ExitStatus {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	return p.lastExit
+}
+
+//Callers must hold stateLock.
+func (p *Program) getState() State {
+	if !p.IsEnabled() {
+		return StateDisabled
+	}
+	if p.state == "" {
+		return StateStopped
+	}
+	return p.state
+}
+
+//Moves the program to the given state, but only if it is currently in one of the allowed states.
+//Otherwise an ErrInvalidState naming the current state and attempted action is returned.
+func (p *Program) transition(action string, to State, from ...State) error {
+	p.stateLock.Lock()
+	current := p.getState()
+	allowed := false
+	for _, v := range from {
+		if v == current {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		p.stateLock.Unlock()
+		return pufferd.CreateErrInvalidState(string(current), action)
+	}
+	p.state = to
+	p.stateLock.Unlock()
+
+	p.stateChanged(current, to)
+	return nil
+}
+
+//Moves the program to the given state regardless of its current state.
+func (p *Program) setState(to State) {
+	p.stateLock.Lock()
+	current := p.getState()
+	p.state = to
+	p.stateLock.Unlock()
+
+	p.stateChanged(current, to)
+}
+
+func (p *Program) stateChanged(from, to State) {
+	if from == to {
+		return
+	}
+
+	logging.Debug("Server %s changed from %s to %s", p.Id(), from, to)
+	if to == StateStarting || to == StateRunning && from != StateStarting {
+		p.resetHealth()
+	}
+	if p.Environment != nil {
+		_ = p.Environment.GetBase().WSManager.WriteMessage(messages.StatusMessage{Running: to == StateRunning, State: string(to)})
+	}
+	p.publish(messages.StatusMessage{Running: to == StateRunning, State: string(to)})
+}
@@ -0,0 +1,201 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/pufferd/v2/environments"
+	"github.com/pufferpanel/pufferd/v2/programs/operations"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+//Creates a standard server in a temporary folder. The returned function kills the server and removes the folder.
+func createTestProgram(t *testing.T, source string) (*Program, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test servers use unix commands")
+	}
+
+	folder, err := ioutil.TempDir("", "pufferd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	environments.LoadModules()
+	operations.LoadOperations()
+	previous := ServerFolder
+	ServerFolder = folder
+	//keeps crash history, console logs and backups written by the server out of the working directory
+	for _, v := range []string{"data.crashes", "data.logs", "data.audit", "data.backups"} {
+		viper.Set(v, filepath.Join(folder, v))
+	}
+
+	p, err := LoadFromData("test", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(p.Environment.GetRootDirectory(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, func() {
+		_ = p.Environment.Kill()
+		_ = p.Environment.WaitForMainProcessFor(5000)
+		ServerFolder = previous
+		_ = os.RemoveAll(folder)
+	}
+}
+
+func TestStop_SendFailureRestoresState(t *testing.T) {
+	//999 is not a signal, so sending the stop code fails
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"sleep","arguments":["30"],"stopCode":999}}`)
+	defer cleanup()
+
+	err := p.Start()
+	if err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+	if state := p.GetState(); state != StateRunning {
+		t.Fatalf("expected %s after start, got %s", StateRunning, state)
+	}
+
+	err = p.Stop()
+	if err == nil {
+		t.Fatal("expected stop to fail")
+	}
+	if state := p.GetState(); state != StateRunning {
+		t.Fatalf("expected %s after failed stop, got %s", StateRunning, state)
+	}
+
+	//a server that is still running can be stopped again, and exiting afterwards is not a crash
+	p.Execution.StopCode = 15
+	err = p.Stop()
+	if err != nil {
+		t.Fatalf("stop failed: %s", err)
+	}
+	err = p.Environment.WaitForMainProcessFor(int(5 * time.Second / time.Millisecond))
+	if err != nil {
+		t.Fatalf("waiting for stop failed: %s", err)
+	}
+	if state := p.GetState(); state != StateStopped {
+		t.Fatalf("expected %s after stop, got %s", StateStopped, state)
+	}
+}
+
+func TestAfterExit_RunsPostCommands(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"true","post":[{"type":"command","commands":["touch post"]}]}}`)
+	defer cleanup()
+
+	err := p.Start()
+	if err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+
+	//the command waits for the main process to be released, so it only runs if the exit callback does not hold it
+	marker := filepath.Join(p.Environment.GetRootDirectory(), "post")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(marker); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("post-execution command did not run")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if state := p.GetState(); state != StateStopped {
+		t.Fatalf("expected %s, got %s", StateStopped, state)
+	}
+}
+
+func TestStop_EscalationDoesNotReachNextProcess(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"sleep","arguments":["30"],"stopCode":15,"stopTimeout":1}}`)
+	defer cleanup()
+
+	err := p.Start()
+	if err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+	err = p.Stop()
+	if err != nil {
+		t.Fatalf("stop failed: %s", err)
+	}
+	err = p.Environment.WaitForMainProcessFor(int(5 * time.Second / time.Millisecond))
+	if err != nil {
+		t.Fatalf("waiting for stop failed: %s", err)
+	}
+
+	//the escalation for the first process would send SIGTERM after one second, and kill after two
+	err = p.Start()
+	if err != nil {
+		t.Fatalf("second start failed: %s", err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+
+	if running, _ := p.IsRunning(); !running {
+		t.Fatalf("expected the second process to still be running, server is %s", p.GetState())
+	}
+	if state := p.GetState(); state != StateRunning {
+		t.Fatalf("expected %s, got %s", StateRunning, state)
+	}
+}
+
+func TestRestart_LeavesNewProcessRunning(t *testing.T) {
+	p, cleanup := createTestProgram(t, `{"environment":{"type":"standard"},"run":{"program":"sleep","arguments":["30"],"stopCode":15,"stopTimeout":1}}`)
+	defer cleanup()
+
+	err := p.Start()
+	if err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+	err = p.Restart()
+	if err != nil {
+		t.Fatalf("restart failed: %s", err)
+	}
+
+	//past the point a stop left escalating would have sent SIGTERM and killed the server
+	time.Sleep(2500 * time.Millisecond)
+
+	if running, _ := p.IsRunning(); !running {
+		t.Fatalf("expected the restarted process to still be running, server is %s", p.GetState())
+	}
+	if state := p.GetState(); state != StateRunning {
+		t.Fatalf("expected %s, got %s", StateRunning, state)
+	}
+}
+
+func TestTransition_RejectsConflictingActions(t *testing.T) {
+	p := CreateProgram()
+
+	err := p.transition("install", StateInstalling, StateStopped, StateCrashed)
+	if err != nil {
+		t.Fatalf("install from %s failed: %s", StateStopped, err)
+	}
+
+	err = p.transition("start", StateStarting, StateStopped, StateCrashed, StateQueued)
+	if err == nil {
+		t.Fatal("expected start while installing to be rejected")
+	}
+	if state := p.GetState(); state != StateInstalling {
+		t.Fatalf("expected %s after rejected start, got %s", StateInstalling, state)
+	}
+}
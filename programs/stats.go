@@ -0,0 +1,170 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+	"github.com/spf13/viper"
+	"sync"
+	"time"
+)
+
+type statsSubscription struct {
+	interval time.Duration
+	next     time.Time
+}
+
+var statsSubscriptions = make(map[*Program]map[*websocket.Conn]*statsSubscription)
+var statsLock = sync.Mutex{}
+var statsDone chan bool
+
+func startStatsCollector() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	statsDone = make(chan bool)
+	go runStatsCollector(statsDone)
+}
+
+func stopStatsCollector() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	if statsDone != nil {
+		close(statsDone)
+		statsDone = nil
+	}
+}
+
+func runStatsCollector(done chan bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var nextHistory time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			collectStats(now)
+			collectHealth(now)
+			if !now.Before(nextHistory) {
+				nextHistory = now.Add(time.Duration(viper.GetInt("stats.historyInterval")) * time.Second)
+				collectStatsHistory(now)
+			}
+		}
+	}
+}
+
+//Samples each server with a subscription due, once, and sends the result to every subscriber that is due.
+func collectStats(now time.Time) {
+	statsLock.Lock()
+	due := make(map[*Program][]*websocket.Conn)
+	for p, subs := range statsSubscriptions {
+		for conn, sub := range subs {
+			if now.Before(sub.next) {
+				continue
+			}
+			sub.next = now.Add(sub.interval)
+			due[p] = append(due[p], conn)
+		}
+	}
+	statsLock.Unlock()
+
+	for p, conns := range due {
+		go p.sendStats(conns)
+	}
+}
+
+func (p *Program) sendStats(conns []*websocket.Conn) {
+	msg := messages.StatMessage{}
+	if stats, err := p.GetStats(); err == nil {
+		msg.ServerStats = *stats
+	}
+
+	for _, conn := range conns {
+		err := p.Environment.GetBase().WSManager.WriteMessageTo(conn, msg)
+		if err != nil {
+			logging.Debug("websocket encountered error, dropping stats subscription (%s)", err.Error())
+			p.UnsubscribeStats(conn)
+		}
+	}
+}
+
+//Sends stats to the socket every interval, until unsubscribed.
+//Intervals are clamped to the range allowed by stats.minInterval and stats.maxInterval.
+func (p *Program) SubscribeStats(conn *websocket.Conn, interval time.Duration) {
+	interval = ClampStatsInterval(interval)
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	subs := statsSubscriptions[p]
+	if subs == nil {
+		subs = make(map[*websocket.Conn]*statsSubscription)
+		statsSubscriptions[p] = subs
+	}
+	subs[conn] = &statsSubscription{interval: interval}
+}
+
+//Clamps how often stats are sent to the range allowed by stats.minInterval and stats.maxInterval.
+func ClampStatsInterval(interval time.Duration) time.Duration {
+	min := time.Duration(viper.GetInt("stats.minInterval")) * time.Second
+	max := time.Duration(viper.GetInt("stats.maxInterval")) * time.Second
+	if interval < min {
+		return min
+	} else if interval > max {
+		return max
+	}
+	return interval
+}
+
+func (p *Program) UnsubscribeStats(conn *websocket.Conn) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	subs := statsSubscriptions[p]
+	if subs == nil {
+		return
+	}
+	delete(subs, conn)
+	if len(subs) == 0 {
+		delete(statsSubscriptions, p)
+	}
+}
+
+//Gets the stats for the server.
+//Samples taken within the last second are shared, so many callers do not each sample the server.
+func (p *Program) GetStats() (*pufferd.ServerStats, error) {
+	p.statsLock.Lock()
+	defer p.statsLock.Unlock()
+
+	if p.lastStats != nil && time.Since(p.lastStatsTime) < time.Second {
+		return p.lastStats, nil
+	}
+
+	stats, err := p.Environment.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	p.lastStats = stats
+	p.lastStatsTime = time.Now()
+	return stats, nil
+}
@@ -0,0 +1,284 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//A fixed size ring of stats samples, oldest first.
+//When stats.historyPersist is set, samples are also appended to a file so they survive a daemon restart.
+type statsHistory struct {
+	samples   []pufferd.ServerStatsSample
+	start     int
+	count     int
+	file      string
+	persisted int
+	lock      sync.Mutex
+}
+
+var statsHistories = make(map[*Program]*statsHistory)
+var statsHistoryLock = sync.Mutex{}
+
+func getStatsHistoryRetention() time.Duration {
+	return time.Duration(viper.GetInt("stats.historyRetention")) * time.Second
+}
+
+func (p *Program) getStatsHistoryFile() string {
+	return apufferi.JoinPath(viper.GetString("data.stats"), p.Id()+".json")
+}
+
+func (p *Program) getStatsHistory() *statsHistory {
+	statsHistoryLock.Lock()
+	defer statsHistoryLock.Unlock()
+
+	history := statsHistories[p]
+	if history != nil {
+		return history
+	}
+
+	interval := viper.GetInt("stats.historyInterval")
+	if interval < 1 {
+		interval = 1
+	}
+	size := viper.GetInt("stats.historyRetention") / interval
+	if size < 1 {
+		size = 1
+	}
+
+	history = &statsHistory{samples: make([]pufferd.ServerStatsSample, size)}
+	if viper.GetBool("stats.historyPersist") {
+		history.file = p.getStatsHistoryFile()
+		if err := history.load(); err != nil {
+			logging.Exception("Error reading stats history for server "+p.Id(), err)
+		}
+	}
+	statsHistories[p] = history
+	return history
+}
+
+//Samples every running server for the stats history.
+func collectStatsHistory(now time.Time) {
+	for _, p := range GetAll() {
+		if p.GetState() != StateRunning {
+			continue
+		}
+		go p.recordStatsHistory(now)
+	}
+}
+
+func (p *Program) recordStatsHistory(now time.Time) {
+	stats, err := p.GetStats()
+	if err != nil || stats == nil {
+		return
+	}
+
+	history := p.getStatsHistory()
+	if err = history.add(pufferd.ServerStatsSample{Time: now.Unix(), ServerStats: *stats}); err != nil {
+		logging.Exception("Error saving stats history for server "+p.Id(), err)
+	}
+}
+
+//Gets the samples taken between from and to, inclusive.
+//If step is not zero, the samples are averaged into one sample per step.
+func (p *Program) GetStatsHistory(from, to time.Time, step time.Duration) []pufferd.ServerStatsSample {
+	samples := p.getStatsHistory().between(from.Unix(), to.Unix())
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+	return downsample(samples, from.Unix(), int64(step/time.Second))
+}
+
+func (p *Program) deleteStatsHistory() error {
+	statsHistoryLock.Lock()
+	delete(statsHistories, p)
+	statsHistoryLock.Unlock()
+
+	err := os.Remove(p.getStatsHistoryFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (h *statsHistory) add(sample pufferd.ServerStatsSample) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.push(sample)
+
+	if h.file == "" {
+		return nil
+	}
+
+	//rewrite the file once it holds twice the retained samples, so it does not grow forever
+	if h.persisted >= len(h.samples)*2 {
+		return h.save()
+	}
+	return h.append(sample)
+}
+
+//Callers must hold the lock.
+func (h *statsHistory) push(sample pufferd.ServerStatsSample) {
+	if h.count < len(h.samples) {
+		h.samples[(h.start+h.count)%len(h.samples)] = sample
+		h.count++
+	} else {
+		h.samples[h.start] = sample
+		h.start = (h.start + 1) % len(h.samples)
+	}
+}
+
+func (h *statsHistory) between(from, to int64) []pufferd.ServerStatsSample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	result := make([]pufferd.ServerStatsSample, 0)
+	for i := 0; i < h.count; i++ {
+		sample := h.samples[(h.start+i)%len(h.samples)]
+		if sample.Time >= from && sample.Time <= to {
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+//Reads persisted samples, skipping any older than the retention.
+//Callers must hold the lock, or be the only user of the history.
+func (h *statsHistory) load() error {
+	file, err := os.Open(h.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer apufferi.Close(file)
+
+	oldest := time.Now().Add(-getStatsHistoryRetention()).Unix()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var sample pufferd.ServerStatsSample
+		if json.Unmarshal(scanner.Bytes(), &sample) != nil {
+			continue
+		}
+		h.persisted++
+		if sample.Time >= oldest {
+			h.push(sample)
+		}
+	}
+	return scanner.Err()
+}
+
+//Callers must hold the lock.
+func (h *statsHistory) append(sample pufferd.ServerStatsSample) error {
+	err := os.MkdirAll(filepath.Dir(h.file), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(h.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer apufferi.Close(file)
+
+	err = json.NewEncoder(file).Encode(sample)
+	if err == nil {
+		h.persisted++
+	}
+	return err
+}
+
+//Replaces the file with the samples currently held.
+//Callers must hold the lock.
+func (h *statsHistory) save() error {
+	err := os.MkdirAll(filepath.Dir(h.file), 0755)
+	if err != nil {
+		return err
+	}
+
+	temp := h.file + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for i := 0; i < h.count && err == nil; i++ {
+		err = encoder.Encode(h.samples[(h.start+i)%len(h.samples)])
+	}
+	apufferi.Close(file)
+	if err != nil {
+		return err
+	}
+
+	h.persisted = h.count
+	return os.Rename(temp, h.file)
+}
+
+//Groups samples into periods of step seconds starting at from.
+//CPU, memory and process counts are averaged; limits, totals and uptime use the latest sample in the period.
+func downsample(samples []pufferd.ServerStatsSample, from, step int64) []pufferd.ServerStatsSample {
+	result := make([]pufferd.ServerStatsSample, 0)
+
+	var current *pufferd.ServerStatsSample
+	var cpu float64
+	var memory, pids, count uint64
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		current.Cpu = cpu / float64(count)
+		current.Memory = memory / count
+		current.Pids = pids / count
+		result = append(result, *current)
+	}
+
+	for _, sample := range samples {
+		bucket := from + (sample.Time-from)/step*step
+		if current == nil || current.Time != bucket {
+			flush()
+			current = &pufferd.ServerStatsSample{Time: bucket}
+			cpu, memory, pids, count = 0, 0, 0, 0
+		}
+
+		cpu += sample.Cpu
+		memory += sample.Memory
+		pids += sample.Pids
+		count++
+
+		current.MemoryLimit = sample.MemoryLimit
+		current.NetworkRx = sample.NetworkRx
+		current.NetworkTx = sample.NetworkTx
+		current.BlockRead = sample.BlockRead
+		current.BlockWrite = sample.BlockWrite
+		current.Uptime = sample.Uptime
+	}
+	flush()
+
+	return result
+}
@@ -0,0 +1,99 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package programs
+
+import (
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+	"sync"
+)
+
+//How many messages a subscriber may fall behind by before it is closed
+const subscriberQueue = 256
+
+//Receives a server's finished console lines, state changes and events as they happen, for clients that
+//cannot hold a websocket open. Console lines are sent one to a message.
+//Messages is closed when the subscriber falls behind or the server is deleted. Clients can then resume
+//from the sequence of the last console line they received.
+type Subscriber struct {
+	Messages chan messages.Message
+}
+
+var subscribers = make(map[*Program]map[*Subscriber]bool)
+var subscriberLock = sync.Mutex{}
+
+func (p *Program) Subscribe() *Subscriber {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	s := &Subscriber{Messages: make(chan messages.Message, subscriberQueue)}
+	subs := subscribers[p]
+	if subs == nil {
+		subs = make(map[*Subscriber]bool)
+		subscribers[p] = subs
+	}
+	subs[s] = true
+	return s
+}
+
+func (p *Program) Unsubscribe(s *Subscriber) {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	p.removeSubscriber(s)
+}
+
+//Callers must hold subscriberLock.
+func (p *Program) removeSubscriber(s *Subscriber) {
+	subs := subscribers[p]
+	if !subs[s] {
+		return
+	}
+	delete(subs, s)
+	close(s.Messages)
+	if len(subs) == 0 {
+		delete(subscribers, p)
+	}
+}
+
+//Closes every subscriber of the server.
+func (p *Program) closeSubscribers() {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	for s := range subscribers[p] {
+		p.removeSubscriber(s)
+	}
+}
+
+//Sends the message to every subscriber without waiting, closing any that have fallen behind.
+func (p *Program) publish(msg messages.Message) {
+	subscriberLock.Lock()
+	defer subscriberLock.Unlock()
+
+	for s := range subscribers[p] {
+		select {
+		case s.Messages <- msg:
+		default:
+			p.removeSubscriber(s)
+		}
+	}
+}
+
+func (p *Program) publishConsoleLine(line pufferd.ConsoleLine) {
+	p.publish(messages.ConsoleLinesMessage{Lines: []pufferd.ConsoleLine{line}})
+}
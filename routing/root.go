@@ -21,14 +21,21 @@ import (
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/apufferi/v4/middleware"
 	"github.com/pufferpanel/apufferi/v4/response"
+	"github.com/pufferpanel/apufferi/v4/scope"
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/audit"
 	_ "github.com/pufferpanel/pufferd/v2/docs"
+	"github.com/pufferpanel/pufferd/v2/httphandlers"
+	"github.com/pufferpanel/pufferd/v2/metrics"
 	"github.com/pufferpanel/pufferd/v2/routing/server"
 	"github.com/pufferpanel/pufferd/v2/routing/swagger"
+	"github.com/spf13/cast"
 	"net/http"
 	"strings"
 )
 
+const maxAuditLimit = 1000
+
 // @title Pufferd API
 // @version 2.0
 // @description PufferPanel daemon service
@@ -41,6 +48,8 @@ func ConfigureWeb() *gin.Engine {
 	{
 		r.Use(gin.Recovery())
 		r.Use(gin.LoggerWithWriter(logging.AsWriter(logging.INFO)))
+		r.Use(metrics.Middleware)
+		r.Use(audit.Middleware)
 		r.Use(func(c *gin.Context) {
 			if c.GetHeader("Connection") == "Upgrade" {
 				return
@@ -62,6 +71,12 @@ func RegisterRoutes(e *gin.Engine) {
 	e.GET("", getStatusGET)
 	e.HEAD("", getStatusHEAD)
 	e.Handle("OPTIONS", "", response.CreateOptions("GET", "HEAD"))
+
+	e.GET("/metrics", httphandlers.OAuth2Handler(scope.ServersAdmin, false), getMetrics)
+	e.OPTIONS("/metrics", response.CreateOptions("GET"))
+
+	e.GET("/audit", httphandlers.OAuth2Handler(scope.ServersAdmin, false), getAudit)
+	e.OPTIONS("/audit", response.CreateOptions("GET"))
 }
 
 // Root godoc
@@ -85,3 +100,71 @@ func getStatusGET(c *gin.Context) {
 func getStatusHEAD(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
+
+// Metrics godoc
+// @Summary Daemon metrics
+// @Description Gets daemon and server metrics in the Prometheus text format
+// @Produce plain
+// @Success 200 {string} string "Metrics"
+// @Failure 401 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Router /metrics [get]
+func getMetrics(c *gin.Context) {
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// Audit godoc
+// @Summary Daemon audit log
+// @Description Gets the actions taken over the API, websockets and SFTP, and the commands sent to servers, newest first
+// @Produce json
+// @Success 200 {array} pufferd.AuditEntry "Matching audit entries"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param limit query int false "Most entries to return, defaults to 100"
+// @Param from query int false "Only return entries recorded at or after this UNIX time"
+// @Param to query int false "Only return entries recorded at or before this UNIX time"
+// @Param actor query string false "Only return entries for this token subject or SFTP user"
+// @Param action query string false "Only return entries for this action" Enums(server.create, server.delete, server.edit, start, stop, restart, kill, install, reload, update, console, file.write, file.delete, file.create, file.rename, schedule.edit, schedule.delete, backup.create, backup.delete, backup.restore)
+// @Param server query string false "Only return entries for this server"
+// @Param transport query string false "Only return entries from this transport" Enums(http, websocket, sftp, schedule, rule, health, daemon)
+// @Param result query string false "Only return entries with this result" Enums(success, denied, failure)
+// @Param path query string false "Only return entries for paths starting with this"
+// @Param command query string false "Only return console entries with a command containing this"
+// @Router /audit [get]
+func getAudit(c *gin.Context) {
+	query := audit.Query{
+		Actor:     c.Query("actor"),
+		Action:    c.Query("action"),
+		Server:    c.Query("server"),
+		Transport: c.Query("transport"),
+		Result:    c.Query("result"),
+		Path:      c.Query("path"),
+		Command:   c.Query("command"),
+	}
+
+	var err error
+	query.Limit, err = cast.ToIntE(c.DefaultQuery("limit", "100"))
+	if err != nil || query.Limit < 1 {
+		query.Limit = 100
+	} else if query.Limit > maxAuditLimit {
+		query.Limit = maxAuditLimit
+	}
+
+	query.From, err = cast.ToInt64E(c.DefaultQuery("from", "0"))
+	if err != nil || query.From < 0 {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+	query.To, err = cast.ToInt64E(c.DefaultQuery("to", "0"))
+	if err != nil || query.To < 0 {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+
+	entries, err := audit.Search(query)
+	if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(http.StatusOK, entries)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/scope"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+	"github.com/pufferpanel/pufferd/v2/programs"
+	"github.com/spf13/cast"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//How often a comment is sent to keep idle streams from being closed by proxies
+const eventKeepAlive = 15 * time.Second
+
+// @Summary Stream server events
+// @Description Streams console lines, stats, state changes and events for the given server as Server-Sent Events, for clients that cannot use the websocket. Each finished console line is sent with its sequence as the event id, so a reconnecting client resumes from the console buffer with Last-Event-ID. Stats are only sent if the token has the servers.stats scope
+// @Produce text/event-stream
+// @Success 200 {object} string "Event stream"
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Param id path string true "Server Identifier"
+// @Param Last-Event-ID header string false "Sequence of the last console line received"
+// @Param interval query int false "Seconds between stats"
+// @Router /server/{id}/events [get]
+func StreamEvents(c *gin.Context) {
+	item, _ := c.Get("server")
+	program := item.(*programs.Program)
+
+	internalMap, _ := c.Get("scopes")
+	scopes := internalMap.([]scope.Scope)
+
+	lastId, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+
+	//subscribe before reading the buffer, so no line is written between the two without being sent
+	subscriber := program.Subscribe()
+	defer program.Unsubscribe(subscriber)
+
+	lines := program.GetEnvironment().GetBase().ConsoleBuffer.Lines()
+	//the sequence restarts with the daemon, so an id past the buffer cannot be resumed from
+	if len(lines) > 0 && lastId > lines[len(lines)-1].Sequence {
+		lastId = 0
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	state := program.GetState()
+	if writeEvent(c, "", messages.StatusMessage{Running: state == programs.StateRunning, State: string(state)}) != nil {
+		return
+	}
+
+	for _, line := range lines {
+		if line.Sequence > lastId {
+			if writeEvent(c, strconv.FormatUint(line.Sequence, 10), messages.ConsoleLinesMessage{Lines: []pufferd.ConsoleLine{line}}) != nil {
+				return
+			}
+			lastId = line.Sequence
+		}
+	}
+	c.Writer.Flush()
+
+	var statsTicker <-chan time.Time
+	if apufferi.ContainsScope(scopes, scope.ServersStat) {
+		ticker := time.NewTicker(programs.ClampStatsInterval(time.Duration(cast.ToInt(c.Query("interval"))) * time.Second))
+		defer ticker.Stop()
+		statsTicker = ticker.C
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	done := c.Request.Context().Done()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case msg, ok := <-subscriber.Messages:
+			if !ok {
+				return
+			}
+			id := ""
+			if console, isConsole := msg.(messages.ConsoleLinesMessage); isConsole {
+				sequence := console.Lines[len(console.Lines)-1].Sequence
+				//already sent from the buffer
+				if sequence <= lastId {
+					continue
+				}
+				id = strconv.FormatUint(sequence, 10)
+			}
+			err = writeEvent(c, id, msg)
+		case <-statsTicker:
+			msg := messages.StatMessage{}
+			if stats, statErr := program.GetStats(); statErr == nil {
+				msg.ServerStats = *stats
+			}
+			err = writeEvent(c, "", msg)
+		case <-keepAlive.C:
+			_, err = c.Writer.WriteString(": keepalive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+//Writes the message as an event named by its key, with the given id if there is one.
+func writeEvent(c *gin.Context, id string, msg messages.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(c.Writer, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", msg.Key(), data)
+	return err
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/pufferpanel/apufferi/v4/response"
 	"github.com/pufferpanel/apufferi/v4/scope"
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/audit"
 	"github.com/pufferpanel/pufferd/v2/httphandlers"
 	"github.com/pufferpanel/pufferd/v2/messages"
 	"github.com/pufferpanel/pufferd/v2/programs"
@@ -39,8 +40,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"time"
 )
 
+const maxConsoleHistoryLimit = 1000
+const maxCommandAuditLimit = 1000
+
 var wsupgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -52,46 +58,92 @@ var wsupgrader = websocket.Upgrader{
 func RegisterRoutes(e *gin.RouterGroup) {
 	l := e.Group("/server")
 	{
-		l.PUT("/:id", httphandlers.OAuth2Handler(scope.ServersCreate, false), CreateServer)
-		l.DELETE("/:id", httphandlers.OAuth2Handler(scope.ServersDelete, true), DeleteServer)
+		l.PUT("/:id", audit.Action(pufferd.AuditActionServerCreate), httphandlers.OAuth2Handler(scope.ServersCreate, false), CreateServer)
+		l.DELETE("/:id", audit.Action(pufferd.AuditActionServerDelete), httphandlers.OAuth2Handler(scope.ServersDelete, true), DeleteServer)
 		l.GET("/:id", httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), GetServerAdmin)
-		l.POST("/:id", httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), EditServerAdmin)
+		l.POST("/:id", audit.Action(pufferd.AuditActionServerEdit), httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), EditServerAdmin)
 		l.OPTIONS("/:id", response.CreateOptions("PUT", "DELETE", "GET", "POST"))
 
 		l.GET("/:id/data", httphandlers.OAuth2Handler(scope.ServersEdit, true), GetServer)
-		l.POST("/:id/data", httphandlers.OAuth2Handler(scope.ServersEdit, true), EditServer)
+		l.POST("/:id/data", audit.Action(pufferd.AuditActionServerEdit), httphandlers.OAuth2Handler(scope.ServersEdit, true), EditServer)
 		l.OPTIONS("/:id/data", response.CreateOptions("GET", "POST"))
 
-		l.POST("/:id/reload", httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), ReloadServer)
+		l.POST("/:id/reload", audit.Action(pufferd.AuditActionReload), httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), ReloadServer)
 		l.OPTIONS("/:id/reload", response.CreateOptions("POST"))
 
-		l.POST("/:id/start", httphandlers.OAuth2Handler(scope.ServersStart, true), StartServer)
+		l.POST("/:id/start", audit.Action(pufferd.AuditActionStart), httphandlers.OAuth2Handler(scope.ServersStart, true), StartServer)
 		l.OPTIONS("/:id/start", response.CreateOptions("POST"))
 
-		l.POST("/:id/stop", httphandlers.OAuth2Handler(scope.ServersStop, true), StopServer)
+		l.POST("/:id/stop", audit.Action(pufferd.AuditActionStop), httphandlers.OAuth2Handler(scope.ServersStop, true), StopServer)
 		l.OPTIONS("/:id/stop", response.CreateOptions("POST"))
 
-		l.POST("/:id/kill", httphandlers.OAuth2Handler(scope.ServersStop, true), KillServer)
+		l.POST("/:id/restart", audit.Action(pufferd.AuditActionRestart), httphandlers.OAuth2Handler(scope.ServersStart, true), httphandlers.OAuth2Handler(scope.ServersStop, true), RestartServer)
+		l.OPTIONS("/:id/restart", response.CreateOptions("POST"))
+
+		l.POST("/:id/kill", audit.Action(pufferd.AuditActionKill), httphandlers.OAuth2Handler(scope.ServersStop, true), KillServer)
 		l.OPTIONS("/:id/kill", response.CreateOptions("POST"))
 
-		l.POST("/:id/install", httphandlers.OAuth2Handler(scope.ServersInstall, true), InstallServer)
+		l.POST("/:id/install", audit.Action(pufferd.AuditActionInstall), httphandlers.OAuth2Handler(scope.ServersInstall, true), InstallServer)
 		l.OPTIONS("/:id/install", response.CreateOptions("POST"))
 
+		l.POST("/:id/update", audit.Action(pufferd.AuditActionUpdate), httphandlers.OAuth2Handler(scope.ServersUpdate, true), UpdateServer)
+		l.OPTIONS("/:id/update", response.CreateOptions("POST"))
+
 		l.GET("/:id/file/*filename", httphandlers.OAuth2Handler(scope.ServersFilesGet, true), GetFile)
-		l.PUT("/:id/file/*filename", httphandlers.OAuth2Handler(scope.ServersFilesPut, true), PutFile)
-		l.DELETE("/:id/file/*filename", httphandlers.OAuth2Handler(scope.ServersFilesPut, true), DeleteFile)
+		l.PUT("/:id/file/*filename", auditPutFile, httphandlers.OAuth2Handler(scope.ServersFilesPut, true), PutFile)
+		l.DELETE("/:id/file/*filename", audit.Action(pufferd.AuditActionFileDelete), httphandlers.OAuth2Handler(scope.ServersFilesPut, true), DeleteFile)
 		l.POST("/:id/file/*filename", httphandlers.OAuth2Handler(scope.ServersFilesPut, true), response.NotImplemented)
 		l.OPTIONS("/:id/file/*filename", response.CreateOptions("GET", "PUT", "DELETE", "POST"))
 
 		l.GET("/:id/console", httphandlers.OAuth2Handler(scope.ServersConsole, true), GetLogs)
-		l.POST("/:id/console", httphandlers.OAuth2Handler(scope.ServersConsoleSend, true), PostConsole)
+		l.POST("/:id/console", audit.Action(pufferd.AuditActionConsole), httphandlers.OAuth2Handler(scope.ServersConsoleSend, true), PostConsole)
 		l.OPTIONS("/:id/console", response.CreateOptions("GET", "POST"))
 
+		l.GET("/:id/console/history", httphandlers.OAuth2Handler(scope.ServersConsole, true), GetConsoleHistory)
+		l.OPTIONS("/:id/console/history", response.CreateOptions("GET"))
+
 		l.GET("/:id/stats", httphandlers.OAuth2Handler(scope.ServersStat, true), GetStats)
 		l.OPTIONS("/:id/stats", response.CreateOptions("GET"))
 
+		l.GET("/:id/stats/history", httphandlers.OAuth2Handler(scope.ServersStat, true), GetStatsHistory)
+		l.OPTIONS("/:id/stats/history", response.CreateOptions("GET"))
+
 		l.GET("/:id/status", httphandlers.OAuth2Handler(scope.ServersStat, true), GetStatus)
 		l.OPTIONS("/:id/status", response.CreateOptions("GET"))
+
+		l.GET("/:id/events", httphandlers.OAuth2Handler(scope.ServersConsole, true), StreamEvents)
+		l.OPTIONS("/:id/events", response.CreateOptions("GET"))
+
+		l.GET("/:id/schedules", httphandlers.OAuth2Handler(scope.ServersEdit, true), GetSchedules)
+		l.POST("/:id/schedules", audit.Action(pufferd.AuditActionScheduleEdit), httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), EditSchedules)
+		l.OPTIONS("/:id/schedules", response.CreateOptions("GET", "POST"))
+
+		l.GET("/:id/backup", httphandlers.OAuth2Handler(scope.ServersFilesGet, true), GetBackups)
+		l.POST("/:id/backup", audit.Action(pufferd.AuditActionBackupCreate), httphandlers.OAuth2Handler(scope.ServersFilesPut, true), CreateBackup)
+		l.OPTIONS("/:id/backup", response.CreateOptions("GET", "POST"))
+
+		l.GET("/:id/backup/:name", httphandlers.OAuth2Handler(scope.ServersFilesGet, true), GetBackup)
+		l.DELETE("/:id/backup/:name", audit.Action(pufferd.AuditActionBackupDelete), httphandlers.OAuth2Handler(scope.ServersFilesPut, true), DeleteBackup)
+		l.OPTIONS("/:id/backup/:name", response.CreateOptions("GET", "DELETE"))
+
+		l.POST("/:id/backup/:name/restore", audit.Action(pufferd.AuditActionBackupRestore), httphandlers.OAuth2Handler(scope.ServersFilesPut, true), RestoreBackup)
+		l.OPTIONS("/:id/backup/:name/restore", response.CreateOptions("POST"))
+
+		l.GET("/:id/logs/files", httphandlers.OAuth2Handler(scope.ServersConsole, true), GetConsoleLogs)
+		l.OPTIONS("/:id/logs/files", response.CreateOptions("GET"))
+
+		l.GET("/:id/logs/files/:name", httphandlers.OAuth2Handler(scope.ServersConsole, true), GetConsoleLog)
+		l.OPTIONS("/:id/logs/files/:name", response.CreateOptions("GET"))
+
+		l.GET("/:id/crashes", httphandlers.OAuth2Handler(scope.ServersConsole, true), GetCrashes)
+		l.OPTIONS("/:id/crashes", response.CreateOptions("GET"))
+
+		l.GET("/:id/audit/commands", httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), GetCommandAudit)
+		l.OPTIONS("/:id/audit/commands", response.CreateOptions("GET"))
+
+		l.PUT("/:id/schedules/:name", audit.Action(pufferd.AuditActionScheduleEdit), httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), PutSchedule)
+		l.DELETE("/:id/schedules/:name", audit.Action(pufferd.AuditActionScheduleDelete), httphandlers.OAuth2Handler(scope.ServersEditAdmin, true), DeleteSchedule)
+		l.OPTIONS("/:id/schedules/:name", response.CreateOptions("PUT", "DELETE"))
 	}
 
 	p := e.Group("/socket")
@@ -107,10 +159,19 @@ func RegisterRoutes(e *gin.RouterGroup) {
 		p.OPTIONS("/:id", response.CreateOptions("GET"))
 	}
 
-	l.POST("", httphandlers.OAuth2Handler(scope.ServersCreate, false), CreateServer)
+	l.POST("", audit.Action(pufferd.AuditActionServerCreate), httphandlers.OAuth2Handler(scope.ServersCreate, false), CreateServer)
 	l.OPTIONS("", response.CreateOptions("POST"))
 }
 
+//Records file uploads as writes, and folders made with the folder query as creates.
+func auditPutFile(c *gin.Context) {
+	if _, mkFolder := c.GetQuery("folder"); mkFolder {
+		audit.SetAction(c, pufferd.AuditActionFileCreate)
+	} else {
+		audit.SetAction(c, pufferd.AuditActionFileWrite)
+	}
+}
+
 // @Summary Starts server
 // @Description Starts the given server
 // @Accept json
@@ -120,6 +181,7 @@ func RegisterRoutes(e *gin.RouterGroup) {
 // @Failure 400 {object} response.Error
 // @Failure 403 {object} response.Empty
 // @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
 // @Failure 500 {object} response.Error
 // @Param id path string true "Server Identifier"
 // @Param wait query bool false "Wait for the operation to complete"
@@ -132,7 +194,9 @@ func StartServer(c *gin.Context) {
 
 	if wait {
 		err := server.Start()
-		if response.HandleError(c, err, http.StatusInternalServerError) {
+		if isInvalidState(err) {
+			response.HandleError(c, err, http.StatusConflict)
+		} else if response.HandleError(c, err, http.StatusInternalServerError) {
 		} else {
 			c.Status(http.StatusNoContent)
 		}
@@ -148,7 +212,7 @@ func StartServer(c *gin.Context) {
 }
 
 // @Summary Stop server
-// @Description Stops the given server
+// @Description Stops the given server, sending SIGTERM and then killing it if it does not stop within its stop timeout
 // @Accept json
 // @Produce json
 // @Success 204 {object} response.Empty "Server stopped"
@@ -156,6 +220,7 @@ func StartServer(c *gin.Context) {
 // @Failure 400 {object} response.Error
 // @Failure 403 {object} response.Empty
 // @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
 // @Failure 500 {object} response.Error
 // @Param id path string true "Server Identifier"
 // @Param wait query bool false "Wait for the operation to complete"
@@ -166,19 +231,57 @@ func StopServer(c *gin.Context) {
 
 	_, wait := c.GetQuery("wait")
 
-	err := server.Stop()
-	if response.HandleError(c, err, http.StatusInternalServerError) {
-		return
+	var err error
+	if wait {
+		err = server.StopAndWait()
+	} else {
+		err = server.Stop()
 	}
 
+	if isInvalidState(err) {
+		response.HandleError(c, err, http.StatusConflict)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Restart server
+// @Description Stops the given server, waits for it to exit and starts it again
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Server restarted"
+// @Success 202 {object} response.Empty "Restart has been queued"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param wait query bool false "Wait for the operation to complete"
+// @Router /server/{id}/restart [post]
+func RestartServer(c *gin.Context) {
+	item, _ := c.Get("server")
+	server := item.(*programs.Program)
+
+	_, wait := c.GetQuery("wait")
+
 	if wait {
-		err = server.GetEnvironment().WaitForMainProcess()
-		if response.HandleError(c, err, http.StatusInternalServerError) {
+		err := server.Restart()
+		if isInvalidState(err) {
+			response.HandleError(c, err, http.StatusConflict)
+		} else if response.HandleError(c, err, http.StatusInternalServerError) {
 		} else {
 			c.Status(http.StatusNoContent)
 		}
 	} else {
-		c.Status(204)
+		go func() {
+			err := server.Restart()
+			if err != nil {
+				logging.Exception(fmt.Sprintf("Error restarting server %s", server.Id()), err)
+			}
+		}()
+		c.Status(http.StatusAccepted)
 	}
 }
 
@@ -276,6 +379,7 @@ func DeleteServer(c *gin.Context) {
 // @Failure 400 {object} response.Error
 // @Failure 403 {object} response.Empty
 // @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
 // @Failure 500 {object} response.Error
 // @Param id path string true "Server Identifier"
 // @Param wait query bool false "Wait for the operation to complete"
@@ -288,7 +392,9 @@ func InstallServer(c *gin.Context) {
 
 	if wait {
 		err := prg.Install()
-		if response.HandleError(c, err, http.StatusInternalServerError) {
+		if isInvalidState(err) {
+			response.HandleError(c, err, http.StatusConflict)
+		} else if response.HandleError(c, err, http.StatusInternalServerError) {
 		} else {
 			c.Status(http.StatusNoContent)
 		}
@@ -301,6 +407,40 @@ func InstallServer(c *gin.Context) {
 	}
 }
 
+// @Summary Update server environment
+// @Description Updates the environment of the given server, such as downloading the latest docker image
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Server updated"
+// @Success 202 {object} response.Empty "Update has been queued"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param wait query bool false "Wait for the operation to complete"
+// @Router /server/{id}/update [post]
+func UpdateServer(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	_, wait := c.GetQuery("wait")
+
+	if wait {
+		err := prg.Update()
+		if response.HandleError(c, err, http.StatusInternalServerError) {
+		} else {
+			c.Status(http.StatusNoContent)
+		}
+	} else {
+		go func(p *programs.Program) {
+			_ = p.Update()
+		}(prg)
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
 // @Summary Edit server data
 // @Description Edits the given server data
 // @Accept json
@@ -575,7 +715,9 @@ func PostConsole(c *gin.Context) {
 
 	d, _ := ioutil.ReadAll(c.Request.Body)
 	cmd := string(d)
-	err := prg.Execute(cmd)
+	err := prg.ExecuteFrom(cmd, getCommandSource(c, pufferd.CommandTransportHttp))
+	//recorded with the command by ExecuteFrom
+	audit.Recorded(c)
 	if response.HandleError(c, err, http.StatusInternalServerError) {
 	} else {
 		c.Status(http.StatusNoContent)
@@ -591,10 +733,11 @@ func GetConsole(c *gin.Context) {
 		return
 	}
 
-	console, _ := program.GetEnvironment().GetConsole()
-	_ = messages.Write(conn, messages.ConsoleMessage{Logs: console})
+	_, structured := c.GetQuery("structured")
+	program.GetEnvironment().AddListener(conn, structured)
+	writeConsole(conn, program, structured)
 
-	program.GetEnvironment().AddListener(conn)
+	go drainSocket(conn, program)
 }
 
 // @Summary Gets server stats
@@ -612,13 +755,52 @@ func GetStats(c *gin.Context) {
 	item, _ := c.Get("server")
 	svr := item.(*programs.Program)
 
-	results, err := svr.GetEnvironment().GetStats()
+	results, err := svr.GetStats()
 	if response.HandleError(c, err, http.StatusInternalServerError) {
 	} else {
 		c.JSON(200, results)
 	}
 }
 
+// @Summary Gets server stats history
+// @Description Gets the stats sampled for the given server between two times, optionally averaged into one sample per step
+// @Accept json
+// @Produce json
+// @Success 200 {array} pufferd.ServerStatsSample "Stats for this server, oldest first"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Param id path string true "Server Identifier"
+// @Param from query int false "UNIX time to start from, defaults to the start of the retained history"
+// @Param to query int false "UNIX time to end at, defaults to now"
+// @Param step query int false "Seconds to average samples over, defaults to returning every sample"
+// @Router /server/{id}/stats/history [get]
+func GetStatsHistory(c *gin.Context) {
+	item, _ := c.Get("server")
+	svr := item.(*programs.Program)
+
+	now := time.Now()
+	to, err := cast.ToInt64E(c.DefaultQuery("to", cast.ToString(now.Unix())))
+	if err != nil || to < 0 {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+
+	from, err := cast.ToInt64E(c.DefaultQuery("from", "0"))
+	if err != nil || from < 0 || from > to {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+
+	step, err := cast.ToInt64E(c.DefaultQuery("step", "0"))
+	if err != nil || step < 0 {
+		response.HandleError(c, pufferd.ErrInvalidStep, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(200, svr.GetStatsHistory(time.Unix(from, 0), time.Unix(to, 0), time.Duration(step)*time.Second))
+}
+
 // @Summary Gets server logs
 // @Description Gets the given server logs since a certain time period
 // @Accept json
@@ -654,6 +836,127 @@ func GetLogs(c *gin.Context) {
 	})
 }
 
+// @Summary Gets server log files
+// @Description Lists the console log files kept for the given server, newest first
+// @Accept json
+// @Produce json
+// @Success 200 {array} pufferd.ServerLogFile "Log files for this server"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Router /server/{id}/logs/files [get]
+func GetConsoleLogs(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	files, err := prg.GetConsoleLogs()
+	if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(200, files)
+	}
+}
+
+// @Summary Download server log file
+// @Description Downloads a console log file of the given server. Older files are gzipped
+// @Accept json
+// @Produce octet-stream
+// @Success 200 {object} string "Log file"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Log file name"
+// @Router /server/{id}/logs/files/{name} [get]
+func GetConsoleLog(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	data, err := prg.OpenConsoleLog(c.Param("name"))
+	defer func() {
+		if data != nil {
+			apufferi.Close(data.Contents)
+		}
+	}()
+
+	if err == pufferd.ErrLogNotFound {
+		c.AbortWithStatus(http.StatusNotFound)
+	} else if err == pufferd.ErrIllegalFileAccess {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		extraHeaders := map[string]string{
+			"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, data.Name),
+		}
+		c.DataFromReader(http.StatusOK, data.ContentLength, "application/octet-stream", data.Contents, extraHeaders)
+	}
+}
+
+// @Summary Search server console history
+// @Description Pages through the console history of the given server, newest first unless paging forward with after
+// @Accept json
+// @Produce json
+// @Success 200 {object} pufferd.ServerConsoleHistory "Matching console lines, oldest first"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param limit query int false "Most lines to return, defaults to 100"
+// @Param before query string false "Cursor to return lines before"
+// @Param after query string false "Cursor to return lines after"
+// @Param contains query string false "Only return lines containing this text"
+// @Param regex query string false "Only return lines matching this regular expression"
+// @Param source query string false "Only return lines from the daemon or the process" Enums(daemon, process)
+// @Param store query string false "Search the lines in memory or the log files, defaults to the log files if they are enabled and no source is given" Enums(memory, files)
+// @Router /server/{id}/console/history [get]
+func GetConsoleHistory(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	query := programs.ConsoleQuery{
+		Before:   c.Query("before"),
+		After:    c.Query("after"),
+		Contains: c.Query("contains"),
+		Source:   c.Query("source"),
+		//only lines held in memory record who wrote them
+		Files: prg.GetEnvironment().GetBase().ConsoleLog != nil && c.Query("source") == "",
+	}
+
+	var err error
+	query.Limit, err = cast.ToIntE(c.DefaultQuery("limit", "100"))
+	if err != nil || query.Limit < 1 {
+		query.Limit = 100
+	} else if query.Limit > maxConsoleHistoryLimit {
+		query.Limit = maxConsoleHistoryLimit
+	}
+
+	if pattern := c.Query("regex"); pattern != "" {
+		query.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			response.HandleError(c, pufferd.ErrInvalidPattern, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch c.Query("store") {
+	case "memory":
+		query.Files = false
+	case "files":
+		query.Files = true
+	}
+
+	results, err := prg.QueryConsole(query)
+	if err == pufferd.ErrInvalidCursor || err == pufferd.ErrIllegalFileAccess || err == pufferd.ErrSourceNotRecorded {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(200, results)
+	}
+}
+
 // @Summary Gets server status
 // @Description Gets the given server status
 // @Accept json
@@ -673,7 +976,368 @@ func GetStatus(c *gin.Context) {
 
 	if response.HandleError(c, err, http.StatusInternalServerError) {
 	} else {
-		c.JSON(200, &pufferd.ServerRunning{Running: running})
+		health, healthy := program.GetHealth()
+		c.JSON(200, &pufferd.ServerRunning{
+			Running:  running,
+			State:    string(program.GetState()),
+			LastExit: program.GetLastExit(),
+			Healthy:  healthy,
+			Health:   health,
+		})
+	}
+}
+
+// @Summary Gets server schedules
+// @Description Gets the scheduled tasks for the given server
+// @Accept json
+// @Produce json
+// @Success 200 {object} programs.Schedule "Schedules for this server, keyed by name"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Router /server/{id}/schedules [get]
+func GetSchedules(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	c.JSON(200, prg.GetSchedules())
+}
+
+// @Summary Replace server schedules
+// @Description Replaces all scheduled tasks for the given server
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Schedules replaced"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param schedules body programs.Schedule true "Schedules, keyed by name"
+// @Router /server/{id}/schedules [post]
+func EditSchedules(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	schedules := make(map[string]programs.Schedule)
+	err := json.NewDecoder(c.Request.Body).Decode(&schedules)
+	if response.HandleError(c, err, http.StatusBadRequest) {
+		return
+	}
+
+	err = prg.SetSchedules(schedules)
+	if err == pufferd.ErrInvalidSchedule {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Put server schedule
+// @Description Creates or replaces a single scheduled task for the given server
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Schedule saved"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Schedule name"
+// @Param schedule body programs.Schedule true "Schedule"
+// @Router /server/{id}/schedules/{name} [put]
+func PutSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	schedule := programs.Schedule{}
+	err := json.NewDecoder(c.Request.Body).Decode(&schedule)
+	if response.HandleError(c, err, http.StatusBadRequest) {
+		return
+	}
+
+	err = prg.SetSchedule(c.Param("name"), schedule)
+	if err == pufferd.ErrInvalidSchedule {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Delete server schedule
+// @Description Deletes a scheduled task from the given server
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Schedule deleted"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Schedule name"
+// @Router /server/{id}/schedules/{name} [delete]
+func DeleteSchedule(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	err := prg.DeleteSchedule(c.Param("name"))
+	if err == pufferd.ErrScheduleNotFound {
+		c.AbortWithStatus(http.StatusNotFound)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Gets server backups
+// @Description Lists the backups for the given server, newest first
+// @Accept json
+// @Produce json
+// @Success 200 {array} pufferd.ServerBackup "Backups for this server"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Router /server/{id}/backup [get]
+func GetBackups(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	backups, err := prg.GetBackups()
+	if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(200, backups)
+	}
+}
+
+// @Summary Backs up server
+// @Description Creates a backup of the given server's files
+// @Accept json
+// @Produce json
+// @Success 200 {object} pufferd.ServerBackup "Backup created"
+// @Success 202 {object} response.Empty "Backup has been queued"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param wait query bool false "Wait for the operation to complete"
+// @Router /server/{id}/backup [post]
+func CreateBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	_, wait := c.GetQuery("wait")
+
+	if wait {
+		backup, err := prg.CreateBackup()
+		if err == pufferd.ErrBackupInProgress {
+			response.HandleError(c, err, http.StatusConflict)
+		} else if response.HandleError(c, err, http.StatusInternalServerError) {
+		} else {
+			c.JSON(200, backup)
+		}
+	} else {
+		go func(p *programs.Program) {
+			_, err := p.CreateBackup()
+			if err != nil {
+				logging.Exception(fmt.Sprintf("Error backing up server %s", p.Id()), err)
+			}
+		}(prg)
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// @Summary Download server backup
+// @Description Downloads a backup of the given server
+// @Accept json
+// @Produce octet-stream
+// @Success 200 {object} string "Backup archive"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Backup name"
+// @Router /server/{id}/backup/{name} [get]
+func GetBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	data, err := prg.OpenBackup(c.Param("name"))
+	defer func() {
+		if data != nil {
+			apufferi.Close(data.Contents)
+		}
+	}()
+
+	if err == pufferd.ErrBackupNotFound {
+		c.AbortWithStatus(http.StatusNotFound)
+	} else if err == pufferd.ErrIllegalFileAccess {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		extraHeaders := map[string]string{
+			"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, data.Name),
+		}
+		c.DataFromReader(http.StatusOK, data.ContentLength, "application/octet-stream", data.Contents, extraHeaders)
+	}
+}
+
+// @Summary Delete server backup
+// @Description Deletes a backup of the given server
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Backup deleted"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Backup name"
+// @Router /server/{id}/backup/{name} [delete]
+func DeleteBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	err := prg.DeleteBackup(c.Param("name"))
+	if err == pufferd.ErrBackupNotFound {
+		c.AbortWithStatus(http.StatusNotFound)
+	} else if err == pufferd.ErrIllegalFileAccess {
+		response.HandleError(c, err, http.StatusBadRequest)
+	} else if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// @Summary Restore server backup
+// @Description Replaces the given server's files with a backup, stopping the server first
+// @Accept json
+// @Produce json
+// @Success 204 {object} response.Empty "Backup restored"
+// @Success 202 {object} response.Empty "Restore has been queued"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 409 {object} response.Error
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param name path string true "Backup name"
+// @Param wait query bool false "Wait for the operation to complete"
+// @Router /server/{id}/backup/{name}/restore [post]
+func RestoreBackup(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	name := c.Param("name")
+	_, wait := c.GetQuery("wait")
+
+	if wait {
+		err := prg.RestoreBackup(name)
+		if err == pufferd.ErrBackupNotFound {
+			c.AbortWithStatus(http.StatusNotFound)
+		} else if err == pufferd.ErrBackupInProgress || isInvalidState(err) {
+			response.HandleError(c, err, http.StatusConflict)
+		} else if err == pufferd.ErrIllegalFileAccess {
+			response.HandleError(c, err, http.StatusBadRequest)
+		} else if response.HandleError(c, err, http.StatusInternalServerError) {
+		} else {
+			c.Status(http.StatusNoContent)
+		}
+	} else {
+		go func(p *programs.Program) {
+			err := p.RestoreBackup(name)
+			if err != nil {
+				logging.Exception(fmt.Sprintf("Error restoring backup %s for server %s", name, p.Id()), err)
+			}
+		}(prg)
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// @Summary Gets server crashes
+// @Description Gets the recorded crashes for the given server, newest first
+// @Accept json
+// @Produce json
+// @Success 200 {array} pufferd.ServerCrash "Crashes for this server"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Router /server/{id}/crashes [get]
+func GetCrashes(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	crashes, err := prg.GetCrashes()
+	if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(200, crashes)
+	}
+}
+
+// @Summary Gets server command audit
+// @Description Gets the commands sent to the given server, with who sent them and how, newest first. These are the console entries of the audit log for the server
+// @Accept json
+// @Produce json
+// @Success 200 {array} pufferd.AuditEntry "Commands sent to this server"
+// @Failure 400 {object} response.Error
+// @Failure 403 {object} response.Empty
+// @Failure 404 {object} response.Empty
+// @Failure 500 {object} response.Error
+// @Param id path string true "Server Identifier"
+// @Param limit query int false "Most commands to return, defaults to 100"
+// @Param from query int false "Only return commands sent at or after this UNIX time"
+// @Param to query int false "Only return commands sent at or before this UNIX time"
+// @Param subject query string false "Only return commands sent with this token subject"
+// @Param transport query string false "Only return commands sent this way" Enums(http, websocket, schedule, rule, health, daemon)
+// @Param contains query string false "Only return commands containing this text"
+// @Router /server/{id}/audit/commands [get]
+func GetCommandAudit(c *gin.Context) {
+	item, _ := c.Get("server")
+	prg := item.(*programs.Program)
+
+	query := audit.Query{
+		Actor:     c.Query("subject"),
+		Action:    pufferd.AuditActionConsole,
+		Server:    prg.Id(),
+		Transport: c.Query("transport"),
+		Command:   c.Query("contains"),
+	}
+
+	var err error
+	query.Limit, err = cast.ToIntE(c.DefaultQuery("limit", "100"))
+	if err != nil || query.Limit < 1 {
+		query.Limit = 100
+	} else if query.Limit > maxCommandAuditLimit {
+		query.Limit = maxCommandAuditLimit
+	}
+
+	query.From, err = cast.ToInt64E(c.DefaultQuery("from", "0"))
+	if err != nil || query.From < 0 {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+	query.To, err = cast.ToInt64E(c.DefaultQuery("to", "0"))
+	if err != nil || query.To < 0 {
+		response.HandleError(c, pufferd.ErrInvalidUnixTime, http.StatusBadRequest)
+		return
+	}
+
+	commands, err := audit.Search(query)
+	if response.HandleError(c, err, http.StatusInternalServerError) {
+	} else {
+		c.JSON(200, commands)
 	}
 }
 
@@ -686,13 +1350,45 @@ func OpenSocket(c *gin.Context) {
 		return
 	}
 
-	console, _ := program.GetEnvironment().GetConsole()
-	_ = messages.Write(conn, messages.ConsoleMessage{Logs: console})
+	//nothing else writes to the socket until it is registered
+	_ = messages.Write(conn, messages.VersionMessage{Version: messages.Version})
 
 	internalMap, _ := c.Get("scopes")
 	scopes := internalMap.([]scope.Scope)
+	source := getCommandSource(c, pufferd.CommandTransportWebsocket)
+
+	//register before reading the console, so no output is missed between the two, and before reading the socket,
+	//so pongs are handled from the first read. Lines written in between may be sent twice, which structured
+	//clients can tell by their sequence
+	_, structured := c.GetQuery("structured")
+	program.GetEnvironment().AddListener(conn, structured)
+
+	writeConsole(conn, program, structured)
+
+	state := program.GetState()
+	_ = program.GetEnvironment().GetBase().WSManager.WriteMessageTo(conn, messages.StatusMessage{Running: state == programs.StateRunning, State: string(state)})
+
+	go listenOnSocket(conn, program, scopes, source)
+}
+
+//Gets who is sending commands on this request, for the command audit.
+func getCommandSource(c *gin.Context, transport string) pufferd.CommandSource {
+	return pufferd.CommandSource{Subject: c.GetString("subject"), Address: c.ClientIP(), Transport: transport}
+}
 
-	go listenOnSocket(conn, program, scopes)
+//Queues the console held in memory for a registered socket, as lines if the socket asked for structured output,
+//or plain text otherwise.
+func writeConsole(conn *websocket.Conn, program *programs.Program, structured bool) {
+	ws := program.GetEnvironment().GetBase().WSManager
+	if structured {
+		_ = ws.WriteMessageTo(conn, messages.ConsoleLinesMessage{Lines: program.GetEnvironment().GetBase().ConsoleBuffer.Entries()})
+	} else {
+		console, _ := program.GetEnvironment().GetConsole()
+		_ = ws.WriteMessageTo(conn, messages.ConsoleMessage{Logs: console})
+	}
+}
 
-	program.GetEnvironment().AddListener(conn)
+func isInvalidState(err error) bool {
+	e, ok := err.(*apufferi.Error)
+	return ok && e.Is(pufferd.ErrInvalidState)
 }
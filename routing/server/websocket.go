@@ -7,21 +7,54 @@ import (
 	"github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/apufferi/v4/scope"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/audit"
 	"github.com/pufferpanel/pufferd/v2/messages"
+	"github.com/pufferpanel/pufferd/v2/metrics"
 	"github.com/pufferpanel/pufferd/v2/programs"
 	"github.com/spf13/viper"
 	"io"
 	path2 "path"
-	"reflect"
 	"strings"
+	"time"
 )
 
-func listenOnSocket(conn *websocket.Conn, server *programs.Program, scopes []scope.Scope) {
+//Scopes each request type needs, on top of the scope needed to open the socket
+var requestScopes = map[string][]scope.Scope{
+	"ping":    {},
+	"stat":    {scope.ServersStat},
+	"start":   {scope.ServersStart},
+	"stop":    {scope.ServersStop},
+	"restart": {scope.ServersStart, scope.ServersStop},
+	"install": {scope.ServersInstall},
+	"kill":    {scope.ServersStop},
+	"reload":  {scope.ServersEditAdmin},
+	"console": {scope.ServersConsoleSend},
+	"file":    {scope.ServersFilesGet},
+}
+
+//Request types that are not recorded in the audit log when they are handled.
+//Pings and stats change nothing, and file changes are recorded with their path when they are made
+var unauditedRequests = map[string]bool{
+	"ping": true,
+	"stat": true,
+	"file": true,
+}
+
+func listenOnSocket(conn *websocket.Conn, server *programs.Program, scopes []scope.Scope, source pufferd.CommandSource) {
 	defer func() {
 		if err := recover(); err != nil {
 			logging.Error("Error with websocket connection for server %s: %s", server.Id(), err)
 		}
 	}()
+	defer server.UnsubscribeStats(conn)
+	//the environment is replaced when the server is reloaded, so look it up on close
+	defer func() {
+		server.GetEnvironment().RemoveListener(conn)
+	}()
+
+	metrics.WebSockets.Inc()
+	defer metrics.WebSockets.Dec()
 
 	for {
 		msgType, data, err := conn.ReadMessage()
@@ -32,158 +65,245 @@ func listenOnSocket(conn *websocket.Conn, server *programs.Program, scopes []sco
 		if msgType != websocket.TextMessage {
 			continue
 		}
-		mapping := make(map[string]interface{})
 
-		err = json.Unmarshal(data, &mapping)
+		request := messages.Request{}
+		err = json.Unmarshal(data, &request)
 		if err != nil {
 			logging.Exception("error on decoding websocket message", err)
+			replyError(conn, server, request, pufferd.ErrInvalidMessage)
 			continue
 		}
 
-		messageType := mapping["type"]
-		if message, ok := messageType.(string); ok {
-			switch strings.ToLower(message) {
-			case "stat":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersStat) {
-						results, err := server.GetEnvironment().GetStats()
-						msg := messages.StatMessage{}
-						if err != nil {
-							msg.Cpu = 0
-							msg.Memory = 0
-						} else {
-							msg.Cpu = results.Cpu
-							msg.Memory = results.Memory
-						}
-						_ = messages.Write(conn, msg)
-					}
-				}
-			case "start":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersStart) {
-						_ = server.Start()
-					}
-					break
-				}
-			case "stop":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersStop) {
-						_ = server.Stop()
-					}
-				}
-			case "install":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersInstall) {
-						_ = server.Install()
-					}
-				}
-			case "kill":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersStop) {
-						_ = server.Kill()
-					}
-				}
-			case "reload":
-				{
-					if apufferi.ContainsScope(scopes, scope.ServersEditAdmin) {
-						_ = programs.Reload(server.Id())
-					}
-				}
-			case "ping":
-				{
-					_ = messages.Write(conn, messages.PongMessage{})
+		handleRequest(conn, server, scopes, source, request)
+	}
+}
+
+//Handles a request, replying with a result or error that echoes the request's id.
+//Actions that change the server's state run in the background, so the socket keeps reading while they run.
+func handleRequest(conn *websocket.Conn, server *programs.Program, scopes []scope.Scope, source pufferd.CommandSource, request messages.Request) {
+	if request.Version > messages.Version {
+		replyError(conn, server, request, pufferd.CreateErrUnsupportedVersion(request.Version, messages.Version))
+		return
+	}
+
+	messageType := strings.ToLower(request.Type)
+	required, known := requestScopes[messageType]
+	if !known {
+		replyError(conn, server, request, pufferd.CreateErrUnknownMessage(request.Type))
+		return
+	}
+	for _, v := range required {
+		if !apufferi.ContainsScope(scopes, v) {
+			err := pufferd.CreateErrMissingScope(v)
+			if !unauditedRequests[messageType] {
+				auditRequest(server, source, messageType, "", err)
+			}
+			replyError(conn, server, request, err)
+			return
+		}
+	}
+
+	switch messageType {
+	case "ping":
+		{
+			reply(conn, server, request, messages.PongMessage{})
+		}
+	case "stat":
+		{
+			//subscribers get stats pushed every interval seconds, instead of asking each time
+			if request.Subscribe != nil {
+				if *request.Subscribe {
+					server.SubscribeStats(conn, time.Duration(request.Interval)*time.Second)
+				} else {
+					server.UnsubscribeStats(conn)
 				}
-			case "console":
+				reply(conn, server, request, messages.ResultMessage{Action: request.Type})
+				break
+			}
+
+			results, err := server.GetStats()
+			if err != nil {
+				replyError(conn, server, request, err)
+				break
+			}
+			reply(conn, server, request, messages.StatMessage{ServerStats: *results})
+		}
+	case "start":
+		{
+			go runRequest(conn, server, source, request, server.Start)
+		}
+	case "stop":
+		{
+			go runRequest(conn, server, source, request, server.Stop)
+		}
+	case "restart":
+		{
+			go runRequest(conn, server, source, request, server.Restart)
+		}
+	case "install":
+		{
+			go runRequest(conn, server, source, request, server.Install)
+		}
+	case "kill":
+		{
+			go runRequest(conn, server, source, request, server.Kill)
+		}
+	case "reload":
+		{
+			go runRequest(conn, server, source, request, func() error {
+				return programs.Reload(server.Id())
+			})
+		}
+	case "console":
+		{
+			if request.Command == "" {
+				replyError(conn, server, request, pufferd.ErrInvalidMessage)
+				break
+			}
+			//run in order, so commands reach the server in the order they were sent.
+			//ExecuteFrom records the command in the audit log, so it is not recorded again here
+			err := server.ExecuteFrom(request.Command, source)
+			if err != nil {
+				replyError(conn, server, request, err)
+			} else {
+				reply(conn, server, request, messages.ResultMessage{Action: request.Type})
+			}
+		}
+	case "file":
+		{
+			switch strings.ToLower(request.Action) {
+			case "get":
 				{
-					cmd, ok := mapping["command"].(string)
-					if ok {
-						if run, _ := server.IsRunning(); run {
-							_ = server.GetEnvironment().ExecuteInMainProcess(cmd)
-						}
-					}
+					handleGetFile(conn, server, request, request.Path, request.Edit)
 				}
-			case "file":
+			case "delete":
 				{
-					if !apufferi.ContainsScope(scopes, scope.ServersFilesGet) {
+					if !apufferi.ContainsScope(scopes, scope.ServersFilesPut) {
+						err := pufferd.CreateErrMissingScope(scope.ServersFilesPut)
+						auditRequest(server, source, pufferd.AuditActionFileDelete, request.Path, err)
+						replyError(conn, server, request, err)
 						break
 					}
 
-					action, ok := mapping["action"].(string)
-					if !ok {
-						break
+					err := server.DeleteItem(request.Path)
+					auditRequest(server, source, pufferd.AuditActionFileDelete, request.Path, err)
+					if err != nil {
+						replyError(conn, server, request, err)
+					} else {
+						//now get the root
+						handleGetFile(conn, server, request, path2.Dir(request.Path), false)
 					}
-					path, ok := mapping["path"].(string)
-					if !ok {
+				}
+			case "create":
+				{
+					if !apufferi.ContainsScope(scopes, scope.ServersFilesPut) {
+						err := pufferd.CreateErrMissingScope(scope.ServersFilesPut)
+						auditRequest(server, source, pufferd.AuditActionFileCreate, request.Path, err)
+						replyError(conn, server, request, err)
 						break
 					}
 
-					switch strings.ToLower(action) {
-					case "get":
-						{
-							editMode, ok := mapping["edit"].(bool)
-							handleGetFile(conn, server, path, ok && editMode)
-						}
-						break
-					case "delete":
-						{
-							if !apufferi.ContainsScope(scopes, scope.ServersFilesPut) {
-								break
-							}
-
-							err := server.DeleteItem(path)
-							if err != nil {
-								_ = messages.Write(conn, messages.FileListMessage{Error: err.Error()})
-							} else {
-								//now get the root
-								handleGetFile(conn, server, path2.Dir(path), false)
-							}
-						}
-						break
-					case "create":
-						{
-							if !apufferi.ContainsScope(scopes, scope.ServersFilesPut) {
-								break
-							}
-
-							err := server.CreateFolder(path)
-
-							if err != nil {
-								_ = messages.Write(conn, messages.FileListMessage{Error: err.Error()})
-							} else {
-								handleGetFile(conn, server, path, false)
-							}
-						}
-						break
+					err := server.CreateFolder(request.Path)
+					auditRequest(server, source, pufferd.AuditActionFileCreate, request.Path, err)
+					if err != nil {
+						replyError(conn, server, request, err)
+					} else {
+						handleGetFile(conn, server, request, request.Path, false)
 					}
 				}
 			default:
-				_ = conn.WriteJSON(map[string]string{"error": "unknown command"})
+				replyError(conn, server, request, pufferd.ErrInvalidMessage)
 			}
-		} else {
-			logging.Error("message type is not a string, but was %s", reflect.TypeOf(messageType))
 		}
 	}
 }
 
-func handleGetFile(conn *websocket.Conn, server *programs.Program, path string, editMode bool) {
+//Runs the action, recording it in the audit log and replying with its result or error.
+func runRequest(conn *websocket.Conn, server *programs.Program, source pufferd.CommandSource, request messages.Request, action func() error) {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Error("Error handling websocket %s request for server %s: %s", request.Type, server.Id(), err)
+		}
+	}()
+
+	err := action()
+	auditRequest(server, source, strings.ToLower(request.Type), "", err)
+	if err != nil {
+		replyError(conn, server, request, err)
+	} else {
+		reply(conn, server, request, messages.ResultMessage{Action: request.Type})
+	}
+}
+
+func handleGetFile(conn *websocket.Conn, server *programs.Program, request messages.Request, path string, editMode bool) {
 	data, err := server.GetItem(path)
 	if err != nil {
-		_ = messages.Write(conn, messages.FileListMessage{Error: err.Error()})
+		replyError(conn, server, request, err)
 		return
 	}
 
 	defer apufferi.Close(data.Contents)
 
 	if data.FileList != nil {
-		_ = messages.Write(conn, messages.FileListMessage{FileList: data.FileList, CurrentPath: path})
+		reply(conn, server, request, messages.FileListMessage{FileList: data.FileList, CurrentPath: path})
 	} else if data.Contents != nil {
 		//if the file is small enough, we'll send it over the websocket
 		if editMode && data.ContentLength < viper.GetInt64("data.maxWSDownloadSize") {
 			var buf bytes.Buffer
 			_, _ = io.Copy(&buf, data.Contents)
-			_ = messages.Write(conn, messages.FileListMessage{Contents: buf.Bytes(), Filename: data.Name})
+			reply(conn, server, request, messages.FileListMessage{Contents: buf.Bytes(), Filename: data.Name})
 		} else {
-			_ = messages.Write(conn, messages.FileListMessage{Url: path, Filename: data.Name})
+			reply(conn, server, request, messages.FileListMessage{Url: path, Filename: data.Name})
+		}
+	}
+}
+
+//Queues a reply to the request behind the messages already queued for the socket, as only one write to a socket
+//may happen at a time.
+func reply(conn *websocket.Conn, server *programs.Program, request messages.Request, msg messages.Message) {
+	err := server.GetEnvironment().GetBase().WSManager.WriteJSONTo(conn, &messages.Transmission{Message: msg, Type: msg.Key(), Id: request.Id})
+	if err != nil {
+		logging.Debug("could not reply to websocket (%s)", err.Error())
+	}
+}
+
+//Records an action taken over the socket in the audit log.
+func auditRequest(server *programs.Program, source pufferd.CommandSource, action, path string, err error) {
+	entry := pufferd.AuditEntry{
+		Actor:     source.Subject,
+		Address:   source.Address,
+		Transport: source.Transport,
+		Action:    action,
+		Server:    server.Id(),
+		Path:      path,
+		Result:    pufferd.AuditResultSuccess,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Result = pufferd.AuditResultFailure
+		if e, ok := err.(*apufferi.Error); ok && e.Is(pufferd.ErrMissingScope) {
+			entry.Result = pufferd.AuditResultDenied
+		}
+	}
+	audit.Record(entry)
+}
+
+func replyError(conn *websocket.Conn, server *programs.Program, request messages.Request, err error) {
+	reply(conn, server, request, messages.ErrorMessage{Action: request.Type, Error: apufferi.FromError(err)})
+}
+
+//Reads from a socket that only receives console output until it closes, so pongs and close frames are handled.
+func drainSocket(conn *websocket.Conn, server *programs.Program) {
+	defer func() {
+		server.GetEnvironment().RemoveListener(conn)
+	}()
+
+	metrics.WebSockets.Inc()
+	defer metrics.WebSockets.Dec()
+
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
 		}
 	}
 }
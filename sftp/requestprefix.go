@@ -23,18 +23,34 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/pkg/sftp"
 	utils "github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/audit"
 )
 
+//Actions commands are recorded as in the audit log. Attributes are not applied and symlinks are not made,
+//so neither is recorded
+var auditActions = map[string]string{
+	"Rename": pufferd.AuditActionFileRename,
+	"Rmdir":  pufferd.AuditActionFileDelete,
+	"Remove": pufferd.AuditActionFileDelete,
+	"Mkdir":  pufferd.AuditActionFileCreate,
+}
+
 type requestPrefix struct {
 	prefix string
+	//Who the requests are recorded in the audit log as
+	server  string
+	user    string
+	address string
 }
 
-func CreateRequestPrefix(prefix string) sftp.Handlers {
-	h := requestPrefix{prefix: prefix}
+func CreateRequestPrefix(prefix, server, user, address string) sftp.Handlers {
+	h := requestPrefix{prefix: prefix, server: server, user: user, address: address}
 
 	return sftp.Handlers{FileCmd: h, FileGet: h, FileList: h, FilePut: h}
 }
@@ -61,10 +77,61 @@ func (rp requestPrefix) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	logging.Devel("Target: %v", request.Target)
 	logging.Devel("-----------------")
 	file, err := rp.getFile(request.Filepath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
-	return file, err
+	if err != nil {
+		rp.audit(pufferd.AuditActionFileWrite, request.Filepath, "", err)
+		return nil, err
+	}
+	return &auditedFile{File: file, rp: rp, path: request.Filepath}, nil
+}
+
+//A file being written over SFTP, which is recorded in the audit log once the client closes it.
+type auditedFile struct {
+	*os.File
+	rp   requestPrefix
+	path string
+	//First error writing to the file, if any
+	err    error
+	closed bool
+	lock   sync.Mutex
 }
 
-func (rp requestPrefix) Filecmd(request *sftp.Request) error {
+func (f *auditedFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	if err != nil {
+		f.lock.Lock()
+		if f.err == nil {
+			f.err = err
+		}
+		f.lock.Unlock()
+	}
+	return n, err
+}
+
+func (f *auditedFile) Close() error {
+	err := f.File.Close()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return err
+	}
+	f.closed = true
+	if f.err != nil {
+		f.rp.audit(pufferd.AuditActionFileWrite, f.path, "", f.err)
+	} else {
+		f.rp.audit(pufferd.AuditActionFileWrite, f.path, "", err)
+	}
+	return err
+}
+
+func (rp requestPrefix) Filecmd(request *sftp.Request) (err error) {
+	//attributes are not applied, so changing them is not recorded
+	if action, ok := auditActions[request.Method]; ok {
+		defer func() {
+			rp.audit(action, request.Filepath, request.Target, err)
+		}()
+	}
+
 	logging.Devel("-----------------")
 	logging.Devel("cmd request [%s]: %s", request.Method, request.Filepath)
 	logging.Devel("Flags: %v", request.Flags)
@@ -114,6 +181,25 @@ func (rp requestPrefix) Filecmd(request *sftp.Request) error {
 	}
 }
 
+//Records a change to the server's files in the audit log.
+func (rp requestPrefix) audit(action, path, target string, err error) {
+	entry := pufferd.AuditEntry{
+		Actor:     rp.user,
+		Address:   rp.address,
+		Transport: pufferd.CommandTransportSftp,
+		Action:    action,
+		Server:    rp.server,
+		Path:      path,
+		Target:    target,
+		Result:    pufferd.AuditResultSuccess,
+	}
+	if err != nil {
+		entry.Result = pufferd.AuditResultFailure
+		entry.Error = err.Error()
+	}
+	audit.Record(entry)
+}
+
 func (rp requestPrefix) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	logging.Devel("-----------------")
 	logging.Devel("list request [%s]: %s", request.Method, request.Filepath)
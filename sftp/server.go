@@ -25,6 +25,7 @@ import (
 	"github.com/pufferpanel/apufferi/v4"
 	"github.com/pufferpanel/apufferi/v4/logging"
 	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/metrics"
 	"github.com/pufferpanel/pufferd/v2/oauth2"
 	"github.com/pufferpanel/pufferd/v2/programs"
 	"github.com/spf13/viper"
@@ -143,6 +144,9 @@ func handleConn(conn net.Conn, config *ssh.ServerConfig) error {
 		return e
 	}
 
+	metrics.SFTPSessions.Inc()
+	defer metrics.SFTPSessions.Dec()
+
 	// The incoming Request channel must be serviced.
 	go PrintDiscardRequests(reqs)
 
@@ -179,7 +183,8 @@ func handleConn(conn net.Conn, config *ssh.ServerConfig) error {
 			}
 		}(requests)
 
-		fs := CreateRequestPrefix(filepath.Join(programs.ServerFolder, sc.Permissions.Extensions["server_id"]))
+		serverId := sc.Permissions.Extensions["server_id"]
+		fs := CreateRequestPrefix(filepath.Join(programs.ServerFolder, serverId), serverId, sc.User(), sc.RemoteAddr().String())
 
 		server := sftp.NewRequestServer(channel, fs)
 
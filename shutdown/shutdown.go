@@ -62,15 +62,18 @@ func Shutdown() *sync.WaitGroup {
 			if !running {
 				return
 			}
-			err = e.Stop()
+			//sends SIGTERM and then kills the server if it does not stop within its stop timeout
+			err = e.StopAndWait()
 			if err != nil {
-				logging.Exception(fmt.Sprintf("Error stopping server %s", e.Id()), err)
-				return
-			}
-			err = e.GetEnvironment().WaitForMainProcess()
-			if err != nil {
-				logging.Exception(fmt.Sprintf("Error stopping server %s", e.Id()), err)
-				return
+				logging.Exception(fmt.Sprintf("Error stopping server %s, killing it", e.Id()), err)
+				err = e.GetEnvironment().Kill()
+				if err == nil {
+					err = e.GetEnvironment().WaitForMainProcessFor(e.GetStopTimeout() * 1000)
+				}
+				if err != nil {
+					logging.Exception(fmt.Sprintf("Error killing server %s", e.Id()), err)
+					return
+				}
 			}
 			logging.Warn("Stopped program %s", e.Id())
 		}(element)
@@ -19,53 +19,235 @@ package utils
 import (
 	"encoding/json"
 	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
 	"github.com/pufferpanel/pufferd/v2/messages"
+	"github.com/spf13/viper"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	//Drops messages for a socket whose queue is full, and keeps the socket open
+	SlowPolicyDrop = "drop"
+	//Closes a socket whose queue is full, so the client can reconnect and read the console buffer again
+	SlowPolicyDisconnect = "disconnect"
+)
+
 type WebSocketManager interface {
-	Register(ws *websocket.Conn)
+	//Adds a socket to send messages to.
+	//Structured sockets receive console output as lines with their source and stream, rather than plain text.
+	Register(ws *websocket.Conn, structured bool)
+
+	//Stops sending to the socket and closes it. Unregistering a socket that is not registered does nothing.
+	Unregister(ws *websocket.Conn)
+
+	//Sends console output to every socket, as plain text or lines depending on how the socket was registered.
+	WriteConsole(plain []byte, lines []pufferd.ConsoleLine) error
+
+	WriteMessage(msg messages.Message) error
 
-	Write(msg []byte) (n int, e error)
+	WriteMessageTo(conn *websocket.Conn, msg messages.Message) error
+
+	WriteJSONTo(conn *websocket.Conn, v interface{}) error
+}
+
+//A registered socket. Messages are queued and written by the socket's own goroutine, so a slow client
+//never blocks the caller.
+type socket struct {
+	conn       *websocket.Conn
+	structured bool
+	queue      chan []byte
+	done       chan bool
+	closeOnce  sync.Once
 }
 
 type wsManager struct {
-	sockets []websocket.Conn
+	sockets map[*websocket.Conn]*socket
 	locker  sync.Mutex
 }
 
 func CreateWSManager() WebSocketManager {
-	return &wsManager{sockets: make([]websocket.Conn, 0), locker: sync.Mutex{}}
+	return &wsManager{sockets: make(map[*websocket.Conn]*socket), locker: sync.Mutex{}}
 }
 
-func (ws *wsManager) Register(conn *websocket.Conn) {
-	ws.sockets = append(ws.sockets, *conn)
+func (ws *wsManager) Register(conn *websocket.Conn, structured bool) {
+	size := viper.GetInt("websocket.queue")
+	if size <= 0 {
+		size = 1
+	}
+	s := &socket{
+		conn:       conn,
+		structured: structured,
+		queue:      make(chan []byte, size),
+		done:       make(chan bool),
+	}
+
+	//clients have to answer pings, or the next read fails once the deadline passes
+	pongWait := 2 * getPingInterval()
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	ws.locker.Lock()
+	if old := ws.sockets[conn]; old != nil {
+		ws.remove(old)
+	}
+	ws.sockets[conn] = s
+	ws.locker.Unlock()
+
+	go ws.run(s)
 }
 
-func (ws *wsManager) Write(source []byte) (n int, e error) {
+func (ws *wsManager) Unregister(conn *websocket.Conn) {
 	ws.locker.Lock()
-	logs := make([]string, 1)
-	logs[0] = string(source)
-	packet := messages.ConsoleMessage{Logs: logs}
-	data, _ := json.Marshal(&messages.Transmission{Message: packet, Type: packet.Key()})
-
-	for i := 0; i < len(ws.sockets); i++ {
-		socket := ws.sockets[i]
-		err := socket.WriteMessage(websocket.TextMessage, data)
+	defer ws.locker.Unlock()
+
+	if s := ws.sockets[conn]; s != nil {
+		ws.remove(s)
+	}
+}
+
+//Callers must hold the lock.
+func (ws *wsManager) remove(s *socket) {
+	if ws.sockets[s.conn] == s {
+		delete(ws.sockets, s.conn)
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+func (ws *wsManager) WriteConsole(plain []byte, lines []pufferd.ConsoleLine) error {
+	var plainData, linesData []byte
+	var err error
+	if len(plain) > 0 {
+		plainData, err = json.Marshal(&messages.Transmission{Message: messages.ConsoleMessage{Logs: []string{string(plain)}}, Type: "console"})
+		if err != nil {
+			return err
+		}
+	}
+	if len(lines) > 0 {
+		linesData, err = json.Marshal(&messages.Transmission{Message: messages.ConsoleLinesMessage{Lines: lines}, Type: "console"})
+		if err != nil {
+			return err
+		}
+	}
+
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	for _, s := range ws.sockets {
+		if s.structured {
+			ws.enqueue(s, linesData)
+		} else {
+			ws.enqueue(s, plainData)
+		}
+	}
+	return nil
+}
+
+//Queues the message for every registered socket.
+func (ws *wsManager) WriteMessage(msg messages.Message) error {
+	data, err := json.Marshal(&messages.Transmission{Message: msg, Type: msg.Key()})
+	if err != nil {
+		return err
+	}
+
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	for _, s := range ws.sockets {
+		ws.enqueue(s, data)
+	}
+	return nil
+}
+
+//Queues the message for a single socket, behind the messages already queued for it.
+func (ws *wsManager) WriteMessageTo(conn *websocket.Conn, msg messages.Message) error {
+	return ws.WriteJSONTo(conn, &messages.Transmission{Message: msg, Type: msg.Key()})
+}
+
+//Queues the value, as JSON, for a single socket, behind the messages already queued for it.
+func (ws *wsManager) WriteJSONTo(conn *websocket.Conn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+
+	s := ws.sockets[conn]
+	if s == nil {
+		return pufferd.ErrSocketClosed
+	}
+	if !ws.enqueue(s, data) {
+		return pufferd.ErrSocketClosed
+	}
+	return nil
+}
+
+//Queues data for the socket without waiting. If the queue is full, the data is dropped or the socket is closed,
+//depending on websocket.slowPolicy. Returns if the socket is still open.
+//Callers must hold the lock.
+func (ws *wsManager) enqueue(s *socket, data []byte) bool {
+	if data == nil {
+		return true
+	}
+
+	select {
+	case s.queue <- data:
+		return true
+	default:
+	}
+
+	if viper.GetString("websocket.slowPolicy") == SlowPolicyDrop {
+		logging.Debug("websocket queue is full, dropping message")
+		return true
+	}
+
+	logging.Debug("websocket queue is full, disconnecting")
+	ws.remove(s)
+	return false
+}
+
+//Writes queued messages to the socket and pings it, until it is unregistered or a write fails.
+func (ws *wsManager) run(s *socket) {
+	pingInterval := getPingInterval()
+	writeTimeout := time.Duration(viper.GetInt("websocket.writeTimeout")) * time.Second
+	if writeTimeout <= 0 {
+		writeTimeout = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-s.done:
+			return
+		case data := <-s.queue:
+			_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err = s.conn.WriteMessage(websocket.TextMessage, data)
+		case <-ticker.C:
+			err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		}
+
 		if err != nil {
 			logging.Debug("websocket encountered error, dropping (%s)", err.Error())
-			if i+1 == len(ws.sockets) {
-				ws.sockets = ws.sockets[:i]
-			} else {
-				ws.sockets = append(ws.sockets[:i], ws.sockets[i+1:]...)
-			}
-			i--
+			ws.Unregister(s.conn)
+			return
 		}
 	}
-	ws.locker.Unlock()
+}
 
-	n = len(source)
-	return
+func getPingInterval() time.Duration {
+	interval := time.Duration(viper.GetInt("websocket.pingInterval")) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return interval
 }
@@ -0,0 +1,139 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package utils
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/messages"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Opens a socket to a server that never reads from its end, returning the daemon's side of the socket.
+//The returned function closes both ends.
+func openStalledSocket(t *testing.T) (*websocket.Conn, func()) {
+	stalled := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		stalled <- conn
+	}))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	peer := <-stalled
+
+	return conn, func() {
+		_ = conn.Close()
+		_ = peer.Close()
+		server.Close()
+	}
+}
+
+func setWebsocketConfig(policy string) {
+	viper.Set("websocket.queue", 16)
+	viper.Set("websocket.slowPolicy", policy)
+	viper.Set("websocket.pingInterval", 30)
+	viper.Set("websocket.writeTimeout", 1)
+}
+
+//Writes enough console output and messages to fill the socket's queue and the connection's buffers many
+//times over, failing if the writes do not all return before the deadline.
+func writeUntilStalled(t *testing.T, ws WebSocketManager) {
+	line := []byte(strings.Repeat("x", 4096) + "\n")
+	lines := []pufferd.ConsoleLine{{Sequence: 1, Line: string(line)}}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2000; i++ {
+			_ = ws.WriteConsole(line, lines)
+			_ = ws.WriteMessage(messages.StatusMessage{Running: true, State: "running"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes to a socket that is not read from blocked the writer")
+	}
+}
+
+func isRegistered(ws *wsManager, conn *websocket.Conn) bool {
+	ws.locker.Lock()
+	defer ws.locker.Unlock()
+	return ws.sockets[conn] != nil
+}
+
+func TestWSManager_DropKeepsStalledSocket(t *testing.T) {
+	setWebsocketConfig(SlowPolicyDrop)
+	conn, cleanup := openStalledSocket(t)
+	defer cleanup()
+
+	ws := CreateWSManager().(*wsManager)
+	ws.Register(conn, false)
+
+	writeUntilStalled(t, ws)
+
+	if !isRegistered(ws, conn) {
+		t.Fatal("expected the socket to stay registered when messages are dropped")
+	}
+	err := ws.WriteMessageTo(conn, messages.StatusMessage{Running: true, State: "running"})
+	if err != nil {
+		t.Fatalf("expected the socket to stay open, got %s", err)
+	}
+
+	ws.Unregister(conn)
+}
+
+func TestWSManager_DisconnectClosesStalledSocket(t *testing.T) {
+	setWebsocketConfig(SlowPolicyDisconnect)
+	conn, cleanup := openStalledSocket(t)
+	defer cleanup()
+
+	ws := CreateWSManager().(*wsManager)
+	ws.Register(conn, true)
+
+	writeUntilStalled(t, ws)
+
+	if isRegistered(ws, conn) {
+		t.Fatal("expected the socket to be removed once its queue was full")
+	}
+	err := ws.WriteMessageTo(conn, messages.StatusMessage{Running: true, State: "running"})
+	if err != pufferd.ErrSocketClosed {
+		t.Fatalf("expected %s writing to a removed socket, got %v", pufferd.ErrSocketClosed, err)
+	}
+
+	//the connection itself is closed, so reading from it fails straight away
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	if err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
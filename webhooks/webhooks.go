@@ -0,0 +1,366 @@
+/*
+ Copyright 2019 Padduck, LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+ 	http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pufferpanel/apufferi/v4"
+	"github.com/pufferpanel/apufferi/v4/logging"
+	"github.com/pufferpanel/pufferd/v2"
+	"github.com/pufferpanel/pufferd/v2/programs"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Pufferd-Signature"
+	HeaderEvent     = "X-Pufferd-Event"
+	HeaderDelivery  = "X-Pufferd-Delivery"
+	HeaderTimestamp = "X-Pufferd-Timestamp"
+)
+
+//A URL that server events are posted to.
+type Endpoint struct {
+	Url    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+	//Events to send, all events are sent when empty
+	Events []string `mapstructure:"events"`
+}
+
+//A pending delivery of one event to one endpoint, persisted in the outbox until it is sent.
+type delivery struct {
+	Id       string          `json:"id"`
+	Url      string          `json:"url"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	//UNIX time of the next attempt
+	Next int64 `json:"next"`
+
+	sending bool
+}
+
+//How many events can wait to be written to the outbox. Events past this are dropped rather than holding up the server
+const eventQueue = 1024
+
+var outbox = make(map[string]*delivery)
+var outboxLock = sync.Mutex{}
+var started = false
+var events = make(chan pufferd.ServerEvent, eventQueue)
+
+//Loads the outbox and starts delivering webhooks for events emitted by servers.
+func Start() {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	if started {
+		return
+	}
+	started = true
+
+	loadOutbox()
+	programs.AddEventListener(enqueue)
+	go persist()
+	go run()
+}
+
+func getEndpoints() []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	err := viper.UnmarshalKey("webhooks.endpoints", &endpoints)
+	if err != nil {
+		logging.Exception("invalid webhook endpoints", err)
+		return make([]Endpoint, 0)
+	}
+	return endpoints
+}
+
+func getEndpoint(url string) (Endpoint, bool) {
+	for _, v := range getEndpoints() {
+		if v.Url == url {
+			return v, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+func (e Endpoint) accepts(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, v := range e.Events {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Endpoint) secret() string {
+	if e.Secret != "" {
+		return e.Secret
+	}
+	return viper.GetString("webhooks.secret")
+}
+
+//Hands the event to persist without waiting, as events can be emitted while server output is being read.
+func enqueue(p *programs.Program, event pufferd.ServerEvent) {
+	select {
+	case events <- event:
+	default:
+		logging.Error("Webhook queue is full, dropping %s event for server %s", event.Event, event.Server)
+	}
+}
+
+//Writes each queued event to the outbox, once for every endpoint that wants it.
+func persist() {
+	for event := range events {
+		addToOutbox(event)
+	}
+}
+
+func addToOutbox(event pufferd.ServerEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Error("%+v\n%s", err, debug.Stack())
+		}
+	}()
+
+	endpoints := getEndpoints()
+	if len(endpoints) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logging.Exception("error encoding webhook for server "+event.Server, err)
+		return
+	}
+
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	now := time.Now().Unix()
+	for _, endpoint := range endpoints {
+		if endpoint.Url == "" || !endpoint.accepts(event.Event) {
+			continue
+		}
+		d := &delivery{
+			Id:      uuid.NewV4().String(),
+			Url:     endpoint.Url,
+			Event:   event.Event,
+			Payload: payload,
+			Next:    now,
+		}
+		if err = d.save(); err != nil {
+			logging.Exception("error saving webhook "+d.Id+" to the outbox", err)
+		}
+		outbox[d.Id] = d
+	}
+}
+
+func run() {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Error("%+v\n%s", err, debug.Stack())
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		outboxLock.Lock()
+		for _, d := range outbox {
+			if !d.sending && d.Next <= now.Unix() {
+				d.sending = true
+				go attempt(d)
+			}
+		}
+		outboxLock.Unlock()
+	}
+}
+
+func attempt(d *delivery) {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Error("%+v\n%s", err, debug.Stack())
+		}
+	}()
+
+	endpoint, exists := getEndpoint(d.Url)
+	if !exists {
+		logging.Info("Dropping webhook %s (%s), %s is no longer configured", d.Id, d.Event, d.Url)
+		outboxLock.Lock()
+		d.remove()
+		outboxLock.Unlock()
+		return
+	}
+
+	err := d.send(endpoint)
+
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+
+	d.sending = false
+	d.Attempts++
+
+	if err == nil {
+		d.remove()
+		return
+	}
+
+	if d.Attempts > viper.GetInt("webhooks.retries") {
+		logging.Error("Giving up on webhook %s (%s) to %s after %d attempts: %s", d.Id, d.Event, d.Url, d.Attempts, err.Error())
+		d.remove()
+		return
+	}
+
+	delay := backoff(d.Attempts)
+	logging.Debug("Webhook %s to %s failed, retrying in %s: %s", d.Id, d.Url, delay, err.Error())
+	d.Next = time.Now().Add(delay).Unix()
+	if err = d.save(); err != nil {
+		logging.Exception("error saving webhook "+d.Id+" to the outbox", err)
+	}
+}
+
+//Doubles the delay after each failed attempt, up to the configured maximum.
+func backoff(attempts int) time.Duration {
+	delay := time.Duration(viper.GetInt("webhooks.backoff")) * time.Second
+	max := time.Duration(viper.GetInt("webhooks.backoffMax")) * time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (d *delivery) send(endpoint Endpoint) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request, err := http.NewRequest(http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "pufferd/"+pufferd.Version)
+	request.Header.Set(HeaderEvent, d.Event)
+	request.Header.Set(HeaderDelivery, d.Id)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	if secret := endpoint.secret(); secret != "" {
+		request.Header.Set(HeaderSignature, "sha256="+Sign(secret, timestamp, d.Payload))
+	}
+
+	client := &http.Client{Timeout: time.Duration(viper.GetInt("webhooks.timeout")) * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer apufferi.Close(response.Body)
+	_, _ = ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %s", response.Status)
+	}
+	return nil
+}
+
+//Computes the hex HMAC-SHA256 of the timestamp and body, joined by a period.
+//Receivers should compare this against the signature header and reject old timestamps.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getOutboxFolder() string {
+	return viper.GetString("data.webhooks")
+}
+
+//Callers must hold outboxLock.
+func (d *delivery) save() error {
+	folder := getOutboxFolder()
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(apufferi.JoinPath(folder, d.Id+".json"), data, 0644)
+}
+
+//Callers must hold outboxLock.
+func (d *delivery) remove() {
+	delete(outbox, d.Id)
+	err := os.Remove(apufferi.JoinPath(getOutboxFolder(), d.Id+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		logging.Exception("error removing webhook "+d.Id+" from the outbox", err)
+	}
+}
+
+//Callers must hold outboxLock.
+func loadOutbox() {
+	folder := getOutboxFolder()
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Exception("error reading webhook outbox", err)
+		}
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(apufferi.JoinPath(folder, file.Name()))
+		if err != nil {
+			logging.Exception("error reading webhook "+file.Name(), err)
+			continue
+		}
+		d := &delivery{}
+		if err = json.Unmarshal(data, d); err != nil || d.Id == "" {
+			logging.Error("Removing invalid webhook %s from the outbox", file.Name())
+			_ = os.Remove(apufferi.JoinPath(folder, file.Name()))
+			continue
+		}
+		outbox[d.Id] = d
+	}
+
+	if len(outbox) > 0 {
+		logging.Info("Loaded %d pending webhooks", len(outbox))
+	}
+}